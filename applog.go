@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// App processes write their output to log files in ~/.pow/.logs rather than
+// to a pipe, which would break (and take them down with SIGPIPE) when gowd
+// exits. That way, the next gowd can adopt them, and pick up their output by
+// tailing the files. Each log starts over when its process is (re)started.
+
+func logDir() string {
+	return os.Getenv("HOME") + "/.pow/.logs"
+}
+
+// logPath returns the log file of one of an app's processes, e.g. "web.1".
+func logPath(appName, process string) string {
+	return filepath.Join(logDir(), appName+"."+process+".log")
+}
+
+// createLog empties the log of a process that is about to start, and opens it
+// for the process to write to.
+func createLog(path string) (*os.File, error) {
+	if err := os.MkdirAll(logDir(), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+}
+
+// logPollInterval is how often log files are checked for new output.
+const logPollInterval = 100 * time.Millisecond
+
+// logTail copies whatever is appended to a log file to a writer, line by
+// line, until it is closed.
+type logTail struct {
+	w    io.Writer
+	done chan struct{}
+
+	mtx     sync.Mutex
+	file    *os.File
+	pending []byte // an incomplete last line
+}
+
+// tailLog starts copying the log at path to w, either from its start or from
+// its current end.
+func tailLog(path string, w io.Writer, fromEnd bool) (*logTail, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if fromEnd {
+		if _, err := file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	t := &logTail{w: w, done: make(chan struct{}), file: file}
+	go t.follow()
+	return t, nil
+}
+
+func (t *logTail) follow() {
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flush(false)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// flush copies the complete lines written so far, or everything, if final.
+func (t *logTail) flush(final bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.file == nil {
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.file.Read(buf)
+		t.pending = append(t.pending, buf[:n]...)
+		if err != nil || n == 0 {
+			break
+		}
+	}
+	end := len(t.pending)
+	if !final {
+		end = bytes.LastIndexByte(t.pending, '\n') + 1
+	}
+	if end > 0 {
+		t.w.Write(t.pending[:end])
+		t.pending = append([]byte(nil), t.pending[end:]...)
+	}
+}
+
+// Close copies what's left, once the processes writing to the log are gone,
+// and stops following it. A nil logTail may be closed, too.
+func (t *logTail) Close() {
+	if t == nil {
+		return
+	}
+	t.flush(true)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+		close(t.done)
+	}
+}
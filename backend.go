@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -12,25 +12,96 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/joho/godotenv"
 )
 
 type Backend struct {
+	name         string
 	appPath      string
 	host         string
-	port         int
 	proxy        bool
-	process      *os.Process
+	command      string
+	pgid         int
+	instances    []*instance
+	balance      string
+	next         uint32
+	alive        int32
 	startedAt    time.Time
-	exited       bool
 	exitChan     chan interface{}
+	crashChan    chan error
 	activityChan chan interface{}
+	done         chan struct{} // closed once the backend is closed or has exited
+	doneOnce     sync.Once
+	readiness    ReadinessConfig
+	discover     bool // look for the port apps actually listen on
+	bootTimeout  time.Duration
+	idleTimeout  time.Duration
+	pinChan      chan bool
+	workers      []*worker
+
+	// also receives the output of web processes, if not nil
+	bootOutput io.Writer
+
+	limits   LimitsConfig
+	cgroup   *cgroup // nil if cgroups aren't available or needed
+	oomKills int     // guarded by mtx
+
+	usageMtx sync.Mutex
+	usage    []resourceUsage
+
+	// the transcript of the setup command, if it ran during this boot
+	setupOutput []byte
+
+	launcher LauncherConfig
+	redact   *redactor
+	procfile string // the name of the Procfile the app was started from
+	// the environment the app was started with, secrets redacted
+	env []envVar
+
+	// touching this file, relative to appPath, restarts the app
+	restartFile string
+
+	// mtx guards the fields below, which the goroutines supervising the
+	// backend's processes share with request handlers and the pool
+	mtx     sync.Mutex
+	booting bool
+	exited  bool
+	closing bool
+	// set when something other than restartFile asks for a restart
+	restartReason string
+	// called in the background whenever the backend's processes have changed
+	onChange func()
+	// called to have the pool restart the backend right away
+	requestRestart func()
+}
+
+// instance is one web process of a backend, e.g. "web.2". Requests are
+// balanced across all instances that are up; an instance that dies is taken
+// out of rotation until it has been respawned. It listens either on a port or
+// on the Unix socket at path. The backend's mtx guards up, port and process.
+type instance struct {
+	name    string
+	port    int
+	path    string
+	env     []string
+	process *os.Process
+	output  *bootLog
+	tail    *logTail // copies the process' log file to output
+	socket  *activationSocket
+	up      bool
+	active  int32 // requests in flight
 }
 
 func (b *Backend) Close() {
+	if !b.stop() {
+		// it has exited already, or someone else is taking it down
+		return
+	}
+	b.finish()
+
 	if b.proxy {
 		log.Println("Terminating", b.appPath, "proxy")
 
@@ -41,42 +112,126 @@ func (b *Backend) Close() {
 		log.Println("Terminated", b.appPath)
 		return
 	}
-	log.Println("Terminating", b.appPath, "pid", b.process.Pid)
+	log.Println("Terminating", b.appPath, "process group", b.pgid)
 
-	err := b.process.Signal(syscall.SIGTERM)
+	// signal the whole process group so that children of the web process
+	// (e.g. forked workers) don't outlive it
+	err := syscall.Kill(-b.pgid, syscall.SIGTERM)
 	if err != nil {
 		log.Println("failed to kill process: ", err)
 		return
 	}
+	// a stopped process would only act on the SIGTERM once it is continued
+	syscall.Kill(-b.pgid, syscall.SIGCONT)
 
-	<-b.exitChan
+	select {
+	case <-b.exitChan:
+	case <-time.After(10 * time.Second):
+		// hung processes may well ignore SIGTERM
+		log.Println(b.appPath, "ignored SIGTERM, killing it")
+		syscall.Kill(-b.pgid, syscall.SIGKILL)
+		<-b.exitChan
+	}
+	go b.cgroup.remove()
 
 	log.Println("Terminated", b.appPath)
 }
 
 func (b *Backend) IsRestartRequested() bool {
-	if b.exited {
-		return true
+	return b.RestartReason() != ""
+}
+
+// RestartReason explains why the backend needs to be restarted, or returns ""
+// if it doesn't.
+func (b *Backend) RestartReason() string {
+	b.mtx.Lock()
+	reason, exited := b.restartReason, b.exited
+	b.mtx.Unlock()
+	if reason != "" {
+		return reason
+	}
+	if exited {
+		return "not running"
 	}
 	if b.proxy {
 		fi, err := os.Stat(b.appPath)
-		if err != nil {
-			return false
+		if err != nil || !fi.ModTime().After(b.startedAt) {
+			return ""
 		}
-		return fi.ModTime().After(b.startedAt)
+		return "proxy file changed"
 	}
-	fi, err := os.Stat(b.appPath + "/tmp/restart.txt")
-	if err != nil {
-		return false
+	fi, err := os.Stat(filepath.Join(b.appPath, b.restartFile))
+	if err != nil || !fi.ModTime().After(b.startedAt) {
+		return ""
 	}
-	return fi.ModTime().After(b.startedAt)
+	return b.restartFile + " touched"
 }
 
 type BootCrash struct {
-	Log  bytes.Buffer
-	Env  []string
-	Cmd  string
-	Path string
+	Log      []byte
+	Env      []string
+	Cmd      string
+	Path     string
+	Limit    string // the resource limit that killed the app, if any
+	Procfile string // where Cmd comes from, if it's from a Procfile
+}
+
+// Exited tells whether all of the backend's web processes are gone.
+func (b *Backend) Exited() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.exited
+}
+
+// stopped tells whether the backend is gone or on its way out, in which case
+// its processes must not be restarted.
+func (b *Backend) stopped() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.exited || b.closing
+}
+
+// finish stops the goroutines watching the backend.
+func (b *Backend) finish() {
+	b.doneOnce.Do(func() { close(b.done) })
+}
+
+// stop marks the backend as closing. It returns false if it was already
+// stopped.
+func (b *Backend) stop() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	stopped := b.exited || b.closing
+	b.closing = true
+	return !stopped
+}
+
+func (b *Backend) isBooting() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.booting
+}
+
+// restart records why the backend needs to be restarted, and has the pool do
+// so right away.
+func (b *Backend) restart(reason string) {
+	b.mtx.Lock()
+	b.restartReason = reason
+	requestRestart := b.requestRestart
+	b.mtx.Unlock()
+	if requestRestart != nil {
+		requestRestart()
+	}
+}
+
+// changed lets the pool know that the backend's processes have changed.
+func (b *Backend) changed() {
+	b.mtx.Lock()
+	onChange := b.onChange
+	b.mtx.Unlock()
+	if onChange != nil {
+		onChange()
+	}
 }
 
 func (b BootCrash) Error() string {
@@ -84,6 +239,12 @@ func (b BootCrash) Error() string {
 }
 
 func SpawnBackend(appName string) (*Backend, error) {
+	return spawnBackend(appName, nil)
+}
+
+// spawnBackend is SpawnBackend, additionally copying the output of the app's
+// web processes to bootOutput while it boots.
+func spawnBackend(appName string, bootOutput io.Writer) (*Backend, error) {
 	pathToApp, err := appDir(appName)
 	if err != nil {
 		return nil, err
@@ -92,112 +253,491 @@ func SpawnBackend(appName string) (*Backend, error) {
 	if err != nil {
 		return nil, err
 	}
+	config, err := loadAppConfig(appName)
+	if err != nil {
+		return nil, err
+	}
 	if fileInfo.IsDir() {
-		return SpawnBackendProcfile(pathToApp)
+		b, err := SpawnBackendProcfile(appName, pathToApp, config, bootOutput)
+		if crash, ok := err.(BootCrash); ok {
+			err = crash.redacted(config.Redact)
+		}
+		return b, err
 	}
-	return SpawnBackendProxy(pathToApp)
+	return SpawnBackendProxy(appName, pathToApp, config)
 }
 
-func SpawnBackendProcfile(pathToApp string) (*Backend, error) {
-	port, err := getFreeTCPPort()
+func SpawnBackendProcfile(appName, pathToApp string, config AppConfig, bootOutput io.Writer) (*Backend, error) {
+	// mistakes in the config are pointed out right away, rather than after
+	// the setup command has run for minutes
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Launcher.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateRedactPatterns(config.Redact); err != nil {
+		return nil, err
+	}
+	if err := config.Readiness.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Liveness.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Limits.validate(); err != nil {
+		return nil, err
+	}
+	if config.UnixSocket && config.SocketActivation {
+		return nil, errors.New("Unix socket backends can't use socket activation")
+	}
+	if !validBalance(config.Balance) {
+		return nil, fmt.Errorf("Unknown balance strategy %q, use round-robin or least-conn", config.Balance)
+	}
+	formation, err := parseFormation(config.Formation)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Spawning", pathToApp, "on port", port)
 
-	env := os.Environ()
+	resolved, err := resolveEnv(appName, pathToApp, config, newBootLog(bootOutput, nil))
+	if err != nil {
+		return nil, err
+	}
+	env := resolved.List()
+	redact := newRedactor(env, config.Redact)
 
-	pathbytes, err := ioutil.ReadFile(os.Getenv("HOME") + "/.pow/.path")
-	path := os.Getenv("PATH")
-	if err == nil {
-		path = string(pathbytes)
+	procfileName := chooseProcfile(pathToApp, config.Procfile, resolved.Get("GOW_PROCFILE"))
+	if bootOutput != nil {
+		fmt.Fprintf(bootOutput, "Using %s\n", procfileName)
+	}
+	procfile, err := ReadProcfile(filepath.Join(pathToApp, procfileName))
+	if err != nil {
+		return nil, err
+	}
+	var CmdName string
+	for _, v := range procfile.Entries {
+		if v.Name == config.WebProcess {
+			CmdName = v.Command
+		}
 	}
-	// remove the old PATH
-	for i, v := range env {
-		if strings.Index(v, "PATH=") == 0 {
-			env = append(env[:i], env[i+1:]...)
+
+	if CmdName == "" {
+		return nil, fmt.Errorf("No '%s' entry found in %s", config.WebProcess, procfileName)
+	}
+
+	setupCommand := config.Setup.Command
+	for _, v := range procfile.Entries {
+		if v.Name == "release" && setupCommand == "" {
+			setupCommand = v.Command
+		}
+	}
+	var setupOutput []byte
+	if setupCommand != "" {
+		output := newBootLog(bootOutput, redact)
+		if err := runSetup(appName, pathToApp, setupCommand, config.Setup, config.Launcher, env, output); err != nil {
+			fmt.Fprintln(output, err)
+			return nil, BootCrash{Log: output.Bytes(), Env: env, Cmd: setupCommand, Path: pathToApp, Procfile: procfileName}
 		}
+		setupOutput = output.Bytes()
 	}
-	env = append(env, "PATH="+path, "PORT="+strconv.Itoa(port))
 
-	// add .env
-	entries, err := godotenv.Read(pathToApp + "/.env")
-	if err == nil {
-		for k, v := range entries {
-			env = append(env, k+"="+v)
+	// there's always at least one web process, otherwise there would be
+	// nothing to send requests to
+	webCount := formationCount(formation, config.WebProcess)
+	if webCount < 1 {
+		webCount = 1
+	}
+	instances := make([]*instance, webCount)
+	for i := range instances {
+		inst := &instance{name: "web." + strconv.Itoa(i+1), env: env}
+		switch {
+		case config.UnixSocket:
+			if err := os.MkdirAll(socketDir(), 0700); err != nil {
+				return nil, err
+			}
+			inst.path = filepath.Join(socketDir(), appName+"."+inst.name+".sock")
+			// don't mistake a socket left over from a crash for the app
+			os.Remove(inst.path)
+			inst.env = envWith(envWith(env, "SOCKET", inst.path), "GOW_SOCKET", inst.path)
+		case config.SocketActivation:
+			inst.socket, err = bindActivationSocket()
+			if err != nil {
+				closeSockets(instances)
+				return nil, err
+			}
+			inst.port = inst.socket.Port()
+			inst.env = envWith(activationEnv(env), "PORT", strconv.Itoa(inst.port))
+		default:
+			inst.port, err = getFreeTCPPort()
+			if err != nil {
+				return nil, err
+			}
+			inst.env = envWith(env, "PORT", strconv.Itoa(inst.port))
 		}
-	} else {
-		// allow absence of .env
-		if !os.IsNotExist(err) {
+		instances[i] = inst
+	}
+
+	// workers get ports relative to the first web process, or to some free
+	// port if web doesn't have one
+	basePort := instances[0].port
+	if basePort == 0 {
+		basePort, err = getFreeTCPPort()
+		if err != nil {
 			return nil, err
 		}
 	}
-
-	procfile, err := ReadProcfile(pathToApp + "/Procfile")
+	workers, err := workersFor(procfile, config.WebProcess, formation, basePort)
 	if err != nil {
+		closeSockets(instances)
 		return nil, err
 	}
-	var CmdName string
-	for _, v := range procfile.Entries {
-		if v.Name == "web" {
-			CmdName = v.Command
+	for _, w := range workers {
+		w.env = envWith(env, "PORT", strconv.Itoa(w.port))
+	}
+
+	log.Println("Spawning", pathToApp, "from", procfileName)
+
+	b := &Backend{name: appName, appPath: pathToApp, host: "127.0.0.1", proxy: false, command: CmdName, instances: instances, balance: config.Balance, startedAt: time.Now(), booting: true, activityChan: make(chan interface{}), done: make(chan struct{}), pinChan: make(chan bool), readiness: config.Readiness, discover: config.PortDiscovery, bootTimeout: config.BootTimeout.Duration, idleTimeout: config.IdleTimeout.Duration, exitChan: make(chan interface{}, 1), crashChan: make(chan error, webCount), workers: workers, bootOutput: bootOutput, limits: config.Limits, setupOutput: setupOutput, launcher: config.Launcher, redact: redact, restartFile: config.RestartFile, procfile: procfileName, env: redactVars(resolved.Vars(), config.Redact)}
+	if config.Limits.needCgroup() {
+		b.cgroup, err = createCgroup(appName, config.Limits)
+		if err != nil {
+			log.Println("not using a cgroup for", appName, "-", err)
+		}
+	}
+	for _, inst := range instances {
+		if err := b.startInstance(inst); err != nil {
+			b.stop()
+			syscall.Kill(-b.pgid, syscall.SIGKILL)
+			closeSockets(instances)
+			go b.cgroup.remove()
+			return nil, err
+		}
+	}
+	for _, w := range workers {
+		if err := b.startWorker(w); err != nil {
+			log.Println("failed to start", pathToApp, w.name, "-", err)
 		}
 	}
 
-	if CmdName == "" {
-		return nil, errors.New("No 'web' entry found in Procfile")
+	log.Println("waiting for spawn result for", pathToApp)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	timeout := timeoutChan(b.bootTimeout)
+	for _, inst := range instances {
+		select {
+		case <-await(b.readinessCheck(inst), stop):
+			b.setUp(inst, true)
+		case <-timeout:
+			log.Println(pathToApp, "failed to become ready")
+			b.stop()
+			syscall.Kill(-b.pgid, syscall.SIGKILL)
+			go b.cgroup.remove()
+			return nil, fmt.Errorf("app failed to become ready within %s (%s check)", b.bootTimeout, b.readiness.Check)
+		case err := <-b.crashChan:
+			log.Println(pathToApp, "crashed while starting")
+			// take down the rest of the formation too
+			b.stop()
+			syscall.Kill(-b.pgid, syscall.SIGTERM)
+			go b.cgroup.remove()
+			return nil, err
+		}
 	}
 
-	cmd := exec.Command("bash", "-c", "exec "+CmdName)
+	log.Println(pathToApp, "came up successfully")
+	b.mtx.Lock()
+	b.booting = false
+	b.mtx.Unlock()
+	go b.watchForActivity()
+	go b.watchUsage()
+	if config.Liveness.Check != "" {
+		go b.watchLiveness(config.Liveness)
+	}
 
-	var bootlog bytes.Buffer
+	return b, nil
+}
 
-	toStderrWithCapture := io.MultiWriter(os.Stderr, &bootlog)
+func (b *Backend) readinessCheck(inst *instance) readinessCheck {
+	if inst.socket != nil && b.readiness.Check == "tcp" {
+		return survivesGracePeriod()
+	}
+	check := b.readiness.check(b.instanceAddress(inst), inst.output)
+	if inst.path != "" || inst.socket != nil || !b.discover {
+		// we know exactly where the app listens
+		return check
+	}
+	return b.withPortDiscovery(inst, check)
+}
 
-	cmd.Stdout = toStderrWithCapture // never write to gowd's stdout
-	cmd.Stderr = toStderrWithCapture
-	cmd.Dir = pathToApp
-	cmd.Env = env
+func (b *Backend) startInstance(inst *instance) error {
+	cmd, err := b.launchInstance(inst)
+	if err != nil {
+		return err
+	}
+	go b.superviseInstance(inst, cmd)
+	return nil
+}
 
-	err = cmd.Start()
+func (b *Backend) launchInstance(inst *instance) (*exec.Cmd, error) {
+	prelude := b.limits.ulimits(b.cgroup != nil)
+	if inst.socket != nil {
+		// exec keeps the pid the same, so it's the one the shell reports in $$
+		prelude += "export LISTEN_PID=$$; "
+	}
+	argv, err := b.launcher.argv(b.command, prelude, true, inst.env)
 	if err != nil {
 		return nil, err
 	}
+	cmd := launch(argv, inst.env)
+	if inst.socket != nil {
+		cmd.ExtraFiles = []*os.File{inst.socket.file}
+	}
 
-	exitChan := make(chan interface{}, 1)
-	b := &Backend{appPath: pathToApp, host: "127.0.0.1", port: port, proxy: false, process: cmd.Process, startedAt: time.Now(), activityChan: make(chan interface{}), exitChan: exitChan}
-	booting := true
-	crashChan := make(chan error, 1)
-	go func() {
-		cmd.Wait()
-		b.exited = true
-		b.exitChan <- new(interface{})
+	path := logPath(b.name, inst.name)
+	logFile, err := createLog(path)
+	if err != nil {
+		return nil, err
+	}
+	// the process gets its own copy
+	defer logFile.Close()
+	inst.output = newBootLog(b.bootOutput, b.redact)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.Dir = b.appPath
+	// run the app in its own process group, so that we can reap it along with
+	// everything it spawned, even after gowd itself has been restarted. The
+	// first web process leads the group, everything else joins it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: b.pgid}
+	b.cgroup.apply(cmd.SysProcAttr)
 
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	if inst.tail, err = tailLog(path, inst.output, false); err != nil {
+		log.Println("not following the output of", b.appPath, inst.name, "-", err)
+	}
+	if b.pgid == 0 {
+		b.pgid = cmd.Process.Pid
+	}
+	b.mtx.Lock()
+	inst.process = cmd.Process
+	b.mtx.Unlock()
+	atomic.AddInt32(&b.alive, 1)
+	log.Println("Started", b.appPath, inst.name, "pid", cmd.Process.Pid, "on", b.instanceAddress(inst))
+	return cmd, nil
+}
+
+// superviseInstance waits for a web process to exit. While the app is booting,
+// that's a crash. Later on, the instance is taken out of rotation and
+// respawned, backing off if it keeps crashing, unless it was the last one
+// standing. Then the whole backend has exited, and will be restarted on the
+// next request.
+func (b *Backend) superviseInstance(inst *instance, cmd *exec.Cmd) {
+	delay := 1 * time.Second
+	for {
+		startedAt := time.Now()
+		err := cmd.Wait()
+		inst.tail.Close()
+		b.setUp(inst, false)
+		last := atomic.AddInt32(&b.alive, -1) == 0
+
+		limit := b.exceededLimit()
+		booting := b.isBooting()
 		if booting {
-			crashChan <- BootCrash{Log: bootlog, Env: env, Cmd: CmdName, Path: pathToApp}
+			crashLog := append(append([]byte(nil), b.setupOutput...), inst.output.Bytes()...)
+			b.crashChan <- BootCrash{Log: crashLog, Env: inst.env, Cmd: b.command, Path: b.appPath, Limit: limit, Procfile: b.procfile}
+		} else if limit != "" {
+			log.Println(b.appPath, inst.name, "was killed for exceeding its", limit)
+			if last {
+				b.mtx.Lock()
+				b.restartReason = "exceeded its " + limit
+				b.mtx.Unlock()
+			}
+		}
+		if last {
+			b.markExited()
+			return
+		}
+		if booting || b.stopped() {
+			return
 		}
-	}()
 
-	log.Println("waiting for spawn result for", pathToApp)
+		if time.Since(startedAt) > 1*time.Minute {
+			delay = 1 * time.Second
+		}
+		log.Println(b.appPath, inst.name, "exited:", err, "- respawning it in", delay)
+		select {
+		case <-time.After(delay):
+		case <-b.done:
+			return
+		}
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+		if b.stopped() {
+			return
+		}
+		cmd, err = b.launchInstance(inst)
+		if err != nil {
+			log.Println("failed to respawn", b.appPath, inst.name, "-", err)
+			return
+		}
 
-	select {
-	case <-awaitTCP(b.Address()):
-		log.Println(pathToApp, "came up successfully")
-		booting = false
-		go b.watchForActivity()
+		stop := make(chan struct{})
+		select {
+		case <-await(b.readinessCheck(inst), stop):
+			b.setUp(inst, true)
+			log.Println(b.appPath, inst.name, "is back in rotation")
+		case <-timeoutChan(b.bootTimeout):
+			log.Println(b.appPath, inst.name, "failed to become ready after respawning")
+			cmd.Process.Kill()
+		case <-b.done:
+			// it's being taken down along with the backend
+		}
+		close(stop)
+		b.changed()
+	}
+}
 
-		return b, nil
-	case <-time.After(30 * time.Second):
-		log.Println(pathToApp, "failed to bind")
-		cmd.Process.Kill()
-		return nil, errors.New("app failed to bind")
-	case err := <-crashChan:
-		log.Println(pathToApp, "crashed while starting")
+// isUp tells whether inst is in rotation.
+func (b *Backend) isUp(inst *instance) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return inst.up
+}
+
+func (b *Backend) setUp(inst *instance, up bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	inst.up = up
+}
+
+// pid returns the pid of inst's current process, or 0 if it has none.
+func (b *Backend) pid(inst *instance) int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if inst.process == nil {
+		return 0
+	}
+	return inst.process.Pid
+}
+
+// AdoptBackend takes over an app process group that was started by a previous
+// gowd instance. Since the processes are not our children, we can't wait for
+// them and have to poll for their exit instead. Web processes and workers keep
+// running in the process group, but are no longer supervised individually.
+func AdoptBackend(state backendState) (*Backend, error) {
+	pathToApp, err := appDir(state.App)
+	if err != nil {
 		return nil, err
 	}
+	if !processGroupAlive(state.Pid, state.Pgid) {
+		return nil, errors.New("process is gone")
+	}
+	if len(state.Addresses) == 0 {
+		return nil, errors.New("no known addresses")
+	}
+	process, err := os.FindProcess(state.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := loadAppConfig(state.App)
+	if err != nil {
+		log.Println("while adopting", state.App, "-", err)
+	}
+
+	b := &Backend{name: state.App, appPath: pathToApp, host: "127.0.0.1", proxy: false, pgid: state.Pgid, startedAt: state.StartedAt, activityChan: make(chan interface{}), done: make(chan struct{}), pinChan: make(chan bool), idleTimeout: config.IdleTimeout.Duration, exitChan: make(chan interface{}, 1)}
+	for i, address := range state.Addresses {
+		inst := &instance{name: "web." + strconv.Itoa(i+1), up: true}
+		if network, addr := splitAddress(address); network == "unix" {
+			inst.path = addr
+		} else {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			inst.port, err = strconv.Atoi(port)
+			if err != nil {
+				return nil, err
+			}
+		}
+		b.instances = append(b.instances, inst)
+	}
+	b.instances[0].process = process
+	b.limits = config.Limits
+	b.restartFile = config.RestartFile
+	if state.Cgroup != "" {
+		if b.cgroup, err = openCgroup(state.Cgroup); err != nil {
+			log.Println("while adopting", state.App, "-", err)
+		}
+		b.oomKills = b.cgroup.oomKills()
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	select {
+	case <-await(connectCheck(b.Address()), stop):
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("process does not accept connections")
+	}
+
+	// pick up the output of the app's processes where the previous gowd left
+	// off, redacted as if we had spawned them
+	b.redact = newRedactor(processEnviron(state.Pid), config.Redact)
+	paths, _ := filepath.Glob(logPath(state.App, "*"))
+	var tails []*logTail
+	for _, path := range paths {
+		if tail, err := tailLog(path, b.redact.Writer(os.Stderr), true); err == nil {
+			tails = append(tails, tail)
+		}
+	}
+
+	go func() {
+		for processGroupAlive(state.Pid, state.Pgid) {
+			time.Sleep(1 * time.Second)
+		}
+		for _, tail := range tails {
+			tail.Close()
+		}
+		b.markExited()
+	}()
+	go b.watchForActivity()
+	go b.watchUsage()
+	if config.Liveness.Check != "" && config.Liveness.validate() == nil {
+		go b.watchLiveness(config.Liveness)
+	}
+
+	log.Println("Adopted", pathToApp, "pid", state.Pid, "on", state.Addresses)
+	return b, nil
 }
 
-func SpawnBackendProxy(pathToApp string) (*Backend, error) {
+func (b *Backend) markExited() {
+	// with nobody left to serve them, connections waiting in an activation
+	// socket's backlog should fail rather than hang
+	closeSockets(b.instances)
+	for _, inst := range b.instances {
+		if inst.path != "" {
+			os.Remove(inst.path)
+		}
+	}
+	b.mtx.Lock()
+	b.exited = true
+	closing := b.closing
+	b.mtx.Unlock()
+	b.finish()
+	if !closing {
+		// nobody is going to Close it now, so take the workers down with
+		// the web processes and clean up here
+		syscall.Kill(-b.pgid, syscall.SIGTERM)
+		go b.cgroup.remove()
+	}
+	b.exitChan <- new(interface{})
+	go b.changed()
+}
+
+func SpawnBackendProxy(appName, pathToApp string, config AppConfig) (*Backend, error) {
 	appbytes, err := ioutil.ReadFile(pathToApp)
 	app := ""
 	if err == nil {
@@ -206,94 +746,153 @@ func SpawnBackendProxy(pathToApp string) (*Backend, error) {
 		log.Println("while reading app file:", err)
 	}
 
-	if strings.HasPrefix(app, "http://") {
-		app = app[7:len(app)]
+	target := &instance{name: "proxy", up: true}
+	host := ""
+	if strings.HasPrefix(app, unixAddressPrefix) {
+		target.path = strings.TrimPrefix(app, unixAddressPrefix)
+		log.Println("Proxying", pathToApp, "to socket", target.path)
 	} else {
-		app = "127.0.0.1:" + app
-	}
+		if strings.HasPrefix(app, "http://") {
+			app = app[7:len(app)]
+		} else {
+			app = "127.0.0.1:" + app
+		}
 
-	host, portstring, err := net.SplitHostPort(app)
-	if err != nil {
-		return nil, err
-	}
+		var portstring string
+		host, portstring, err = net.SplitHostPort(app)
+		if err != nil {
+			return nil, err
+		}
 
-	port, err := strconv.Atoi(portstring)
-	if err != nil {
-		return nil, err
-	}
+		target.port, err = strconv.Atoi(portstring)
+		if err != nil {
+			return nil, err
+		}
 
-	log.Println("Proxying", pathToApp, "to host", host, "on port", port)
+		log.Println("Proxying", pathToApp, "to host", host, "on port", target.port)
+	}
 
 	exitChan := make(chan interface{}, 1)
-	b := &Backend{appPath: pathToApp, host: host, port: port, proxy: true, process: nil, startedAt: time.Now(), activityChan: make(chan interface{}), exitChan: exitChan}
+	b := &Backend{name: appName, appPath: pathToApp, host: host, proxy: true, instances: []*instance{target}, startedAt: time.Now(), activityChan: make(chan interface{}), done: make(chan struct{}), pinChan: make(chan bool), idleTimeout: config.IdleTimeout.Duration, exitChan: exitChan}
 	go func() {
 		<-b.exitChan
+		b.mtx.Lock()
 		b.exited = true
+		b.mtx.Unlock()
 		b.exitChan <- new(interface{})
 	}()
 
+	stop := make(chan struct{})
+	defer close(stop)
 	select {
-	case <-awaitTCP(b.Address()):
+	case <-await(connectCheck(b.Address()), stop):
 		log.Println(pathToApp, "came up successfully")
 		go b.watchForActivity()
 
 		return b, nil
-	case <-time.After(30 * time.Second):
+	case <-timeoutChan(config.BootTimeout.Duration):
 		log.Println(pathToApp, "failed to bind")
 		return nil, errors.New("app failed to bind")
 	}
 }
 
 func (b *Backend) Touch() {
-	if b.activityChan != nil {
-		b.activityChan <- new(interface{})
+	select {
+	case b.activityChan <- new(interface{}):
+	default:
+		// the watcher is gone, or busy shutting the backend down
+	}
+}
+
+// setPinned keeps the backend from being stopped when idle, or lets it be
+// again. Either way, the idle countdown starts over.
+func (b *Backend) setPinned(pinned bool) {
+	select {
+	case b.pinChan <- pinned:
+	case <-b.done:
 	}
 }
 
+// Address returns the address of the backend's first web process.
 func (b *Backend) Address() string {
-	return net.JoinHostPort(b.host, strconv.Itoa(b.port))
+	return b.instanceAddress(b.instances[0])
+}
+
+func (b *Backend) instanceAddress(inst *instance) string {
+	if inst.path != "" {
+		return unixAddressPrefix + inst.path
+	}
+	b.mtx.Lock()
+	port := inst.port
+	b.mtx.Unlock()
+	return net.JoinHostPort(b.host, strconv.Itoa(port))
 }
 
-// Close the backend after inactivity
+// Close the backend after inactivity, unless it is pinned or its idle timeout
+// is disabled. Any activity (including pinning and unpinning) restarts the
+// countdown.
 func (b *Backend) watchForActivity() {
-outer:
+	pinned := false
 	for {
-		select {
-		case _, ok := <-b.activityChan:
-			if ok {
-				continue
-			} else {
-				b.Close()
-				b.activityChan = nil
-				break outer
-			}
+		var idle <-chan time.Time
+		if !pinned && b.idleTimeout > 0 {
+			idle = time.After(b.idleTimeout)
+		}
 
-		case <-time.After(30 * time.Minute):
+		select {
+		case <-b.activityChan:
+		case pinned = <-b.pinChan:
+		case <-idle:
 			log.Println(b.appPath, "backend idling.")
 			b.Close()
-			b.activityChan = nil
-			break outer
+			return
+		case <-b.done:
+			// closed or replaced by someone else
+			return
 		}
 	}
 }
 
-func awaitTCP(address string) chan bool {
-	c := make(chan bool)
-	go func() {
-		for {
-			_, err := net.Dial("tcp", address)
-			if err == nil {
-				c <- true
-				break
-			}
-			time.Sleep(200 * time.Millisecond)
+// processGroupAlive reports whether pid is still running as a member of
+// process group pgid. Checking the group guards against a recycled pid.
+func processGroupAlive(pid, pgid int) bool {
+	if pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	actual, err := syscall.Getpgid(pid)
+	return err == nil && actual == pgid
+}
+
+// reapProcessGroup terminates a process group we no longer track, escalating
+// to SIGKILL if it doesn't go away in time.
+func reapProcessGroup(pgid int) {
+	if pgid <= 0 || syscall.Kill(-pgid, syscall.SIGTERM) != nil {
+		return
+	}
+	for i := 0; i < 50; i++ {
+		if syscall.Kill(-pgid, 0) != nil {
+			return
 		}
-	}()
-	return c
+		time.Sleep(200 * time.Millisecond)
+	}
+	log.Println("process group", pgid, "ignored SIGTERM, killing it")
+	syscall.Kill(-pgid, syscall.SIGKILL)
+}
+
+// envWith returns a copy of env in which key is set to value.
+func envWith(env []string, key, value string) []string {
+	result := make([]string, 0, len(env)+1)
+	for _, v := range env {
+		if !strings.HasPrefix(v, key+"=") {
+			result = append(result, v)
+		}
+	}
+	return append(result, key+"="+value)
 }
 
 func getFreeTCPPort() (port int, err error) {
-	// We still have a small race condition here, but meh.
+	// We still have a small race condition here, but meh. Apps that support
+	// socket activation can avoid it.
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		return 0, err
@@ -303,6 +902,25 @@ func getFreeTCPPort() (port int, err error) {
 	return port, nil
 }
 
+// chooseProcfile picks the Procfile to start the app from: the first that
+// exists of the one named by GOW_PROCFILE, the configured one and
+// Procfile.dev, or else Procfile. That way, a global procfile setting doesn't
+// break apps that don't have such a file.
+func chooseProcfile(pathToApp, configured, fromEnv string) string {
+	for _, name := range []string{fromEnv, configured, "Procfile.dev"} {
+		if name == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(pathToApp, name)); err == nil {
+			return name
+		}
+		if name != "Procfile.dev" {
+			log.Println(pathToApp, "has no", name+", looking further")
+		}
+	}
+	return "Procfile"
+}
+
 func appDir(name string) (path string, err error) {
 	path, err = filepath.EvalSymlinks(os.Getenv("HOME") + "/.pow/" + name)
 	return
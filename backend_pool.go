@@ -1,72 +1,411 @@
 package main
 
 import (
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 type BackendPool struct {
 	backends map[string]*Backend
+	pinned   map[string]bool
+	prewarm  map[string]string
+	restarts map[string]restartRecord
+	spawning map[string]*sync.Mutex
+	boots    map[string]*bootProgress
+	held     map[string]int
 	mtx      sync.Mutex
+	closing  bool
+}
+
+type restartRecord struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
 }
 
 func NewBackendPool() *BackendPool {
-	return &BackendPool{backends: make(map[string]*Backend)}
+	return &BackendPool{backends: make(map[string]*Backend), pinned: make(map[string]bool), prewarm: make(map[string]string), restarts: make(map[string]restartRecord), spawning: make(map[string]*sync.Mutex), boots: make(map[string]*bootProgress), held: make(map[string]int)}
 }
 
-func (p *BackendPool) Select(host string) (string, error) {
-	// Yes, we are this crazy. Lock the mutex during the entire lookup time, which could potentially include
-	// (re)spawning an application. Serialize all of this so that we never have to deal with thundering-herd
-	// spawns and such.
-	// TODO: we could at least lock the spawn process by app name
-	p.mtx.Lock()
-	defer p.mtx.Unlock()
+func (p *BackendPool) Select(host string) (string, func(), error) {
+	name := appForHost(host)
+	if err := p.takeBootError(name); err != nil {
+		return "", nil, err
+	}
 
-	name := appNameFromHost(host)
-	var err error
-	p.restartIfRequested(name)
+	config, _ := loadAppConfig(name) // if it's broken, spawning will tell
+	backend, err := p.heldBackend(name, config, config.HoldTimeout.Duration)
+	if err != nil {
+		return "", nil, err
+	}
 
+	backend.Touch()
+
+	address, release := backend.Acquire()
+	return address, release, nil
+}
+
+// backend returns the running backend for the named app, (re)spawning it if
+// necessary. Spawning is serialized per app, so that we never have to deal
+// with thundering-herd spawns and such, but different apps can boot at the
+// same time. The output of the app's web processes is copied to bootOutput,
+// if given.
+func (p *BackendPool) backend(name string, bootOutput io.Writer) (*Backend, error) {
+	lock := p.spawnLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := p.restartIfRequested(name, bootOutput); err != nil {
+		return nil, err
+	}
+
+	p.mtx.Lock()
 	backend := p.backends[name]
+	p.mtx.Unlock()
 
 	if backend == nil {
-		backend, err = SpawnBackend(name)
-
-		if err == nil {
-			p.backends[name] = backend
-		} else {
-			return "", err
+		var err error
+		backend, err = spawnBackend(name, bootOutput)
+		if err != nil {
+			return nil, err
 		}
+		p.mtx.Lock()
+		p.track(name, backend)
+		p.mtx.Unlock()
 	}
+	return backend, nil
+}
 
-	backend.Touch()
+func (p *BackendPool) spawnLock(name string) *sync.Mutex {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
 
-	return backend.Address(), nil
+	lock := p.spawning[name]
+	if lock == nil {
+		lock = new(sync.Mutex)
+		p.spawning[name] = lock
+	}
+	return lock
 }
 
-func (p *BackendPool) restartIfRequested(name string) error {
-	if p.backends[name] == nil || !p.backends[name].IsRestartRequested() {
+// restartIfRequested must be called with the app's spawn lock held.
+func (p *BackendPool) restartIfRequested(name string, bootOutput io.Writer) error {
+	p.mtx.Lock()
+	backend := p.backends[name]
+	p.mtx.Unlock()
+
+	if backend == nil {
+		return nil
+	}
+	reason := backend.RestartReason()
+	if reason == "" {
 		return nil
 	}
-	log.Println("restarting", name)
+	log.Println("restarting", name+":", reason)
 
-	p.backends[name].Close()
+	p.mtx.Lock()
+	p.restarts[name] = restartRecord{Reason: reason, At: time.Now()}
+	p.mtx.Unlock()
+
+	backend.Close()
 
-	refreshed_backend, err := SpawnBackend(name)
+	refreshed_backend, err := spawnBackend(name, bootOutput)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
 
 	if err != nil {
+		// forget the old backend, so that the next request tries again
+		delete(p.backends, name)
+		p.saveState()
 		return err
 	}
 
-	p.backends[name] = refreshed_backend
+	p.track(name, refreshed_backend)
 
 	return nil
 }
 
+// Booting returns the boot of host's app that is in progress, starting one in
+// the background if the app isn't running or needs a restart. It returns nil
+// if the app is ready to serve requests right away.
+func (p *BackendPool) Booting(host string) *bootProgress {
+	name := appForHost(host)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if boot := p.boots[name]; boot != nil {
+		if boot.finished() {
+			// the outcome is picked up by the next call to Select
+			return nil
+		}
+		return boot
+	}
+	if b := p.backends[name]; b != nil && !b.IsRestartRequested() {
+		return nil
+	}
+
+	boot := &bootProgress{log: new(bootLog), done: make(chan struct{})}
+	p.boots[name] = boot
+	go func() {
+		_, boot.err = p.backend(name, boot.log)
+		boot.log.Close()
+		close(boot.done)
+	}()
+	return boot
+}
+
+// takeBootError forgets about a finished background boot of the app, and
+// returns its error so that it can be shown (once) in place of the app.
+func (p *BackendPool) takeBootError(name string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	boot := p.boots[name]
+	if boot == nil || !boot.finished() {
+		return nil
+	}
+	delete(p.boots, name)
+	return boot.err
+}
+
+// Prewarm boots the given apps in the background, so that the first request
+// doesn't have to wait for them. At most parallelism apps boot at once.
+func (p *BackendPool) Prewarm(names []string, parallelism int) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	for _, name := range names {
+		p.setPrewarmStatus(name, "queued")
+	}
+
+	slots := make(chan bool, parallelism)
+	var wg sync.WaitGroup
+	for _, name := range names {
+		slots <- true
+		wg.Add(1)
+		go func(name string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			log.Println("prewarming", name)
+			p.setPrewarmStatus(name, "booting")
+			started := time.Now()
+			if _, err := p.backend(name, nil); err != nil {
+				log.Println("failed to prewarm", name, "-", err)
+				p.setPrewarmStatus(name, "failed: "+err.Error())
+				return
+			}
+			log.Println("prewarmed", name, "in", time.Since(started))
+			p.setPrewarmStatus(name, "ready")
+		}(name)
+	}
+	wg.Wait()
+	log.Println("done prewarming", len(names), "apps")
+}
+
+func (p *BackendPool) setPrewarmStatus(name, status string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.prewarm[name] = status
+}
+
+// track registers a freshly started backend. Must be called with p.mtx held.
+func (p *BackendPool) track(name string, backend *Backend) {
+	if p.closing {
+		// we're shutting down, and nobody would stop it later on
+		backend.Close()
+		return
+	}
+	if p.pinned[name] {
+		backend.setPinned(true)
+	}
+	backend.mtx.Lock()
+	backend.requestRestart = func() {
+		go p.backend(name, nil)
+	}
+	backend.onChange = func() {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		p.saveState()
+	}
+	backend.mtx.Unlock()
+	p.backends[name] = backend
+	p.saveState()
+}
+
+// Pin keeps an app from being stopped when idle, regardless of its configured
+// idle timeout, until it is unpinned again or gowd exits.
+func (p *BackendPool) Pin(name string, pinned bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if pinned {
+		p.pinned[name] = true
+	} else {
+		delete(p.pinned, name)
+	}
+	if b := p.backends[name]; b != nil && !b.Exited() {
+		b.setPinned(pinned)
+	}
+}
+
+// saveState records all running app processes in the state file, so that
+// they can be recovered after gowd restarts. Must be called with p.mtx held.
+func (p *BackendPool) saveState() {
+	if p.closing {
+		return
+	}
+	states := []backendState{}
+	for name, b := range p.backends {
+		if b.proxy || b.Exited() {
+			continue
+		}
+		state := backendState{App: name, Pid: b.pid(b.instances[0]), Pgid: b.pgid, StartedAt: b.startedAt}
+		if b.cgroup != nil {
+			state.Cgroup = b.cgroup.path
+		}
+		for _, inst := range b.instances {
+			state.Addresses = append(state.Addresses, b.instanceAddress(inst))
+		}
+		states = append(states, state)
+	}
+	if err := writeState(states); err != nil {
+		log.Println("failed to save state:", err)
+	}
+}
+
+// Restore brings back the apps that were running before gowd was restarted.
+// Processes that survived are adopted if they still serve requests; all others
+// are reaped and spawned anew.
+func (p *BackendPool) Restore() {
+	states, err := readState()
+	if err != nil {
+		log.Println("failed to read state:", err)
+		return
+	}
+
+	for _, state := range states {
+		p.restore(state)
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.saveState()
+}
+
+func (p *BackendPool) restore(state backendState) {
+	lock := p.spawnLock(state.App)
+	lock.Lock()
+	defer lock.Unlock()
+
+	p.mtx.Lock()
+	running := p.backends[state.App]
+	p.mtx.Unlock()
+	if running != nil {
+		// a request got to it first; whatever survived from before is in
+		// the way now (unless its pgid got recycled for the new one)
+		log.Println("not restoring", state.App, "- it is running already")
+		if running.pgid != state.Pgid {
+			reapState(state)
+		}
+		return
+	}
+
+	if state.Pid != 0 {
+		backend, err := AdoptBackend(state)
+		if err == nil {
+			p.mtx.Lock()
+			p.track(state.App, backend)
+			p.mtx.Unlock()
+			return
+		}
+		log.Println("not adopting", state.App, "pid", state.Pid, "-", err)
+		reapState(state)
+	}
+
+	log.Println("restoring", state.App)
+	backend, err := SpawnBackend(state.App)
+	if err != nil {
+		log.Println("failed to restore", state.App, "-", err)
+		return
+	}
+	p.mtx.Lock()
+	p.track(state.App, backend)
+	p.mtx.Unlock()
+}
+
+// reapState terminates the processes of an app recorded in the state file,
+// and removes its cgroup.
+func reapState(state backendState) {
+	if state.Pid == 0 {
+		return
+	}
+	// only touch the group if the process we recorded is still in it;
+	// otherwise the pgid might have been recycled by now
+	if processGroupAlive(state.Pid, state.Pgid) {
+		reapProcessGroup(state.Pgid)
+	}
+	if state.Cgroup != "" {
+		if c, err := openCgroup(state.Cgroup); err == nil {
+			go c.remove()
+		}
+	}
+}
+
 func (p *BackendPool) Close() {
-	for k := range p.backends {
-		p.backends[k].Close()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	// remember what was running, so that we can bring it back on the next start
+	p.closing = true
+	states := []backendState{}
+	for name, b := range p.backends {
+		if !b.proxy && !b.Exited() {
+			states = append(states, backendState{App: name})
+		}
+		b.Close()
+	}
+	if err := writeState(states); err != nil {
+		log.Println("failed to save state:", err)
+	}
+}
+
+// appForHost finds the app that serves host. That's the app in ~/.pow named
+// like host without .dev and any subdomains, or else the app that lists host
+// among its hostnames.
+func appForHost(host string) string {
+	name := appNameFromHost(host)
+	if _, err := os.Lstat(os.Getenv("HOME") + "/.pow/" + name); err == nil {
+		return name
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		return name
+	}
+	entries, _ := ioutil.ReadDir(os.Getenv("HOME") + "/.pow")
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		app, err := cfg.App(entry.Name())
+		if err != nil {
+			continue
+		}
+		for _, hostname := range app.Hostnames {
+			if strings.EqualFold(hostname, host) {
+				return entry.Name()
+			}
+		}
 	}
+	return name
 }
 
 func appNameFromHost(host string) string {
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestSimpleBackendSpawn(t *testing.T) {
@@ -100,19 +110,1330 @@ func TestProxy(t *testing.T) {
 	b.Close()
 }
 
-var Tempdir string
+func TestRestoreAdoptsRunningBackend(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app4", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app4/Procfile", []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo hello\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewBackendPool()
+	address, release, err := pool.Select("app4.dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
 
-func TestMain(m *testing.M) {
-	var err error
-	Tempdir, err = ioutil.TempDir("", "gow-test")
+	// pretend gowd crashed and came back up, without closing the old pool
+	restored := NewBackendPool()
+	restored.Restore()
+
+	b := restored.backends["app4"]
+	if b == nil {
+		t.Fatal("app4 should have been restored")
+	}
+	if b.instances[0].process.Pid != pool.backends["app4"].instances[0].process.Pid {
+		t.Fatal("app4 should have been adopted, but was respawned with pid", b.instances[0].process.Pid)
+	}
+	if b.Address() != address {
+		t.Fatal("address should have been", address, "but was", b.Address())
+	}
+
+	restored.Close()
+}
+
+func TestRestoreAdoptsBackendOfExitedGowd(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app31", 0700)
 	if err != nil {
-		log.Fatalln(err)
+		t.Fatal(err)
 	}
-	os.Setenv("HOME", Tempdir)
-	err = os.Mkdir(Tempdir+"/.pow", 0700)
+	// an app that keeps writing output, which must not kill it once the gowd
+	// that started it is gone
+	err = ioutil.WriteFile(Tempdir+"/.pow/app31/Procfile", []byte("web: sh -c 'socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo; echo hello\" & while true; do echo still here; sleep 0.1; done'\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper := exec.Command(os.Args[0], "-test.run=^$")
+	helper.Env = append(os.Environ(), "GOW_TEST_HELPER=spawn", "GOW_TEST_APP=app31")
+	helper.Stderr = os.Stderr
+	if err := helper.Run(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	states, err := readState()
+	if err != nil || len(states) != 1 || states[0].App != "app31" {
+		t.Fatal("expected the state of app31, got", states, err)
+	}
+	pool := NewBackendPool()
+	pool.Restore()
+	defer pool.Close()
+
+	b := pool.backends["app31"]
+	if b == nil {
+		t.Fatal("app31 should have been restored")
+	}
+	if b.pid(b.instances[0]) != states[0].Pid {
+		t.Fatal("app31 should have been adopted, but was respawned with pid", b.pid(b.instances[0]))
+	}
+	resp, err := http.Get("http://" + b.Address() + "/")
+	if err != nil {
+		t.Fatal("adopted app should still serve requests, got", err)
+	}
+	resp.Body.Close()
+}
+
+func TestFormation(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app5", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app5/Procfile", []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo hello\"\nworker: sh -c 'echo $PORT > worker-$PORT; sleep 60'\nclock: sh -c 'echo $PORT > clock-$PORT; sleep 60'\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app5]\nformation = \"web=1 worker=2\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	b, err := SpawnBackend("app5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	port := b.instances[0].port
+	for _, port := range []int{port + 100, port + 101} {
+		if _, err := os.Stat(fmt.Sprintf("%s/.pow/app5/worker-%d", Tempdir, port)); err != nil {
+			t.Fatal("worker should have been started on port", port, "-", err)
+		}
+	}
+	if matches, _ := filepath.Glob(Tempdir + "/.pow/app5/clock-*"); len(matches) != 0 {
+		t.Fatal("clock should not have been started, but found", matches)
+	}
+}
+
+func TestLoadBalancing(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app6", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app6/Procfile", []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo $PORT\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app6]\nformation = \"web=2\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	b, err := SpawnBackend("app6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	first, release := b.Acquire()
+	release()
+	second, release := b.Acquire()
+	release()
+	if first == second {
+		t.Fatal("requests should have been spread across both web processes, but both went to", first)
+	}
+
+	b.instances[1].process.Kill()
+	for i := 0; b.isUp(b.instances[1]) && i < 20; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		address, release := b.Acquire()
+		release()
+		if address != b.Address() {
+			t.Fatal("dead web process should have been taken out of rotation, but got", address)
+		}
+	}
+
+	for i := 0; !b.isUp(b.instances[1]) && i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !b.isUp(b.instances[1]) {
+		t.Fatal("dead web process should have been respawned")
+	}
+}
+
+func TestIdleTimeoutAndPinning(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app7", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app7/Procfile", []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo hello\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app7]\nidle_timeout = \"500ms\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	pool := NewBackendPool()
+	defer pool.Close()
+	pool.Pin("app7", true)
+	_, release, err := pool.Select("app7.dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	b := pool.backends["app7"]
+	time.Sleep(1 * time.Second)
+	if b.Exited() {
+		t.Fatal("pinned app should not have been stopped")
+	}
+
+	pool.Pin("app7", false)
+	time.Sleep(1 * time.Second)
+	if !b.Exited() {
+		t.Fatal("unpinned app should have been stopped after its idle timeout")
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	for _, name := range []string{"app8", "app9"} {
+		err := os.Mkdir(Tempdir+"/.pow/"+name, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(Tempdir+"/.pow/"+name+"/Procfile", []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo hello\"\n"), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool := NewBackendPool()
+	defer pool.Close()
+	pool.Prewarm([]string{"app8", "app9", "nonexistent"}, 2)
+
+	status := pool.Status()
+	for _, name := range []string{"app8", "app9"} {
+		if pool.backends[name] == nil {
+			t.Fatal(name, "should have been prewarmed")
+		}
+		if status.Prewarm[name] != "ready" {
+			t.Fatal(name, "should have been reported as ready, but was", status.Prewarm[name])
+		}
+	}
+	if !strings.HasPrefix(status.Prewarm["nonexistent"], "failed: ") {
+		t.Fatal("nonexistent app should have been reported as failed, but was", status.Prewarm["nonexistent"])
+	}
+}
+
+func TestBootPage(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app16", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app16/Procfile", []byte("web: sh -c 'echo warming up; sleep 1; exec \"$0\" \"$@\"' socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo hello\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewBackendPool()
+	defer pool.Close()
+	handler := makeProxyHandlerFunc(pool, nil)
+
+	page := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://app16.dev/", nil)
+		r.Header.Set("Accept", "text/html,application/xhtml+xml")
+		handler(w, r)
+		return w
+	}
+
+	w := page()
+	if w.Code != 503 || !strings.Contains(w.Body.String(), "Starting app16") {
+		t.Fatal("expected the boot page, got", w.Code, w.Body.String())
+	}
+
+	// streams until the app is up
+	events := httptest.NewRecorder()
+	handler(events, httptest.NewRequest("GET", "http://app16.dev"+bootEventsPath, nil))
+	if !strings.Contains(events.Body.String(), `data: "warming up\n"`) || !strings.HasSuffix(events.Body.String(), "event: ready\ndata:\n\n") {
+		t.Fatal("unexpected boot events:", events.Body.String())
+	}
+
+	w = page()
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != "hello" {
+		t.Fatal("expected the app once it is up, got", w.Code, w.Body.String())
+	}
+}
+
+func TestWantsBootPage(t *testing.T) {
+	for _, c := range []struct {
+		headers map[string]string
+		want    bool
+	}{
+		{map[string]string{"Accept": "text/html", "Sec-Fetch-Mode": "navigate", "Sec-Fetch-Dest": "document"}, true},
+		{map[string]string{"Accept": "text/html", "Sec-Fetch-Mode": "cors", "Sec-Fetch-Dest": "empty"}, false},
+		{map[string]string{"Accept": "text/html", "Sec-Fetch-Mode": "navigate", "Sec-Fetch-Dest": "iframe"}, false},
+		{map[string]string{"Accept": "text/html,application/xhtml+xml"}, true},
+		{map[string]string{"Accept": "application/json"}, false},
+	} {
+		r := httptest.NewRequest("GET", "http://app.dev/", nil)
+		for name, value := range c.headers {
+			r.Header.Set(name, value)
+		}
+		if wantsBootPage(r) != c.want {
+			t.Fatal("expected wantsBootPage to be", c.want, "for", c.headers)
+		}
+	}
+}
+
+func TestHoldTimeoutSparesColdBoots(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app34", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app34/Procfile", []byte("web: sh -c 'sleep 2; exec socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo; echo hello\"'\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app34/.gow.toml", []byte("hold_timeout = \"1s\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewBackendPool()
+	defer pool.Close()
+	_, release, err := pool.Select("app34.dev")
+	if err != nil {
+		t.Fatal("a cold boot should have been waited for, got", err)
+	}
+	release()
+}
+
+func TestHoldRequestsDuringRestart(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app17", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app17/Procfile", []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo hello\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app18]\nhold_queue = 0\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	pool := NewBackendPool()
+	defer pool.Close()
+	handler := makeProxyHandlerFunc(pool, nil)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://app17.dev/", nil))
+	if w.Code != 200 {
+		t.Fatal("expected app17 to respond, got", w.Code, w.Body.String())
+	}
+
+	// the request is held until the app has been brought back
+	syscall.Kill(-pool.backends["app17"].pgid, syscall.SIGKILL)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://app17.dev/", nil))
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != "hello" {
+		t.Fatal("expected the request to be replayed, got", w.Code, w.Body.String())
+	}
+
+	// no room in the queue
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://app18.dev/", nil))
+	if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected a 503 with Retry-After, got", w.Code, w.Header())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	if size, err := parseSize("512M"); err != nil || size != 512<<20 {
+		t.Fatal("512M should be", 512<<20, "bytes, got", size, err)
+	}
+	if _, err := parseSize("lots"); err == nil {
+		t.Fatal("expected an error for an invalid size")
+	}
+
+	err := os.Mkdir(Tempdir+"/.pow/app19", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app19/Procfile", []byte("web: sh -c 'echo open files: $(ulimit -n); exec \"$0\" \"$@\"' socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo hello\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app19.limits]\nopen_files = 64\nmemory = \"1G\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	b, err := SpawnBackend("app19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if output := string(b.instances[0].output.Bytes()); !strings.Contains(output, "open files: 64") {
+		t.Fatal("open files limit should have been applied, but output was", output)
+	}
+}
+
+func TestLogReadinessCheck(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app10", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// binds right away, but takes a while until it's really done booting
+	err = ioutil.WriteFile(Tempdir+"/.pow/app10/Procfile", []byte("web: sh -c 'socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo; echo hello\" & sleep 1; echo Listening on $PORT; wait'\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app10.readiness]\ncheck = \"log\"\npattern = \"Listening on \\\\d+\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	started := time.Now()
+	b, err := SpawnBackend("app10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if time.Since(started) < 1*time.Second {
+		t.Fatal("app should only have been considered ready once it logged that it's listening")
+	}
+}
+
+func TestLivenessRestartsHungBackend(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app11", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app11/Procfile", []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo hello\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app11.liveness]\ncheck = \"http\"\ninterval = \"200ms\"\ntimeout = \"200ms\"\nfailures = 2\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	pool := NewBackendPool()
+	defer pool.Close()
+	_, release, err := pool.Select("app11.dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	// a stopped process still has its socket accepting connections, but
+	// never answers, just like a deadlocked one
+	hung := pool.backends["app11"]
+	syscall.Kill(-hung.pgid, syscall.SIGSTOP)
+
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		pool.mtx.Lock()
+		b := pool.backends["app11"]
+		pool.mtx.Unlock()
+		if b != hung {
+			if !strings.Contains(pool.restarts["app11"].Reason, "liveness") {
+				t.Fatal("restart reason should mention the liveness check, but was", pool.restarts["app11"].Reason)
+			}
+			return
+		}
+	}
+	t.Fatal("hung backend should have been restarted")
+}
+
+func TestSocketActivation(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app12", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test binary doubles as a socket-activated server, see TestMain
+	err = ioutil.WriteFile(Tempdir+"/.pow/app12/Procfile", []byte("web: env GOW_TEST_HELPER=listenfds "+os.Args[0]+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app12]\nsocket_activation = true\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	b, err := SpawnBackend("app12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	resp, err := http.Get("http://" + b.Address() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello from fd 3" {
+		t.Fatal("body should have been 'hello from fd 3', but was:", string(body))
+	}
+}
+
+func TestSocketActivatedBootCrash(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app32", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app32/Procfile", []byte("web: echo SyntaxError; exit 1\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app32/.gow.toml", []byte("socket_activation = true\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := SpawnBackend("app32")
+	if err == nil {
+		b.Close()
+	}
+	crash, ok := err.(BootCrash)
+	if !ok || !strings.Contains(string(crash.Log), "SyntaxError") {
+		t.Fatal("expected a boot crash with the app's output, got", err)
+	}
+}
+
+// serveListenFDs is a minimal socket-activated server.
+func serveListenFDs() {
+	if os.Getenv("LISTEN_FDS") != "1" || os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		log.Fatalln("not socket-activated:", os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_PID"))
+	}
+	l, err := net.FileListener(os.NewFile(3, "web"))
 	if err != nil {
 		log.Fatalln(err)
 	}
+	log.Fatalln(http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from fd 3")
+	})))
+}
 
-	os.Exit(m.Run())
+func TestUnixSocketBackend(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app13", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app13/Procfile", []byte("web: env GOW_TEST_HELPER=unix "+os.Args[0]+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app13]\nunix_socket = true\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	b, err := SpawnBackend("app13")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if !strings.HasPrefix(b.Address(), "unix:") {
+		t.Fatal("address should have been a socket, but was", b.Address())
+	}
+
+	// proxy files can point at sockets, too
+	err = ioutil.WriteFile(Tempdir+"/.pow/app14", []byte(b.Address()+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := SpawnBackend("app14")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	w := httptest.NewRecorder()
+	proxyRequest(w, httptest.NewRequest("GET", "http://app14.dev/", nil), proxy.Address())
+	if w.Body.String() != "hello from a socket" {
+		t.Fatal("body should have been 'hello from a socket', but was:", w.Body.String())
+	}
+}
+
+// serveUnixSocket is a minimal server listening on $SOCKET.
+func serveUnixSocket() {
+	l, err := net.Listen("unix", os.Getenv("SOCKET"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Fatalln(http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from a socket")
+	})))
+}
+
+func TestDiscoverPortOfAppIgnoringPORT(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("port discovery needs /proc")
+	}
+	err := os.Mkdir(Tempdir+"/.pow/app15", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hardcoded, err := getFreeTCPPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app15/Procfile", []byte(fmt.Sprintf("web: socat TCP-LISTEN:%d,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo; echo hello\"\n", hardcoded)), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app15/.gow.toml", []byte("port_discovery = true\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := SpawnBackend("app15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if b.instances[0].port != hardcoded {
+		t.Fatal("backend should have been found on port", hardcoded, "but was routed to", b.instances[0].port)
+	}
+}
+
+var Tempdir string
+
+// resolvedEnv resolves the environment the named app's processes would get, with
+// the values of secrets redacted.
+func resolvedEnv(appName string) ([]envVar, error) {
+	pathToApp, err := appDir(appName)
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadAppConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	env, err := resolveEnv(appName, pathToApp, config, nil)
+	if err != nil {
+		return nil, err
+	}
+	return redactVars(env.Vars(), config.Redact), nil
+}
+
+func TestMain(m *testing.M) {
+	switch os.Getenv("GOW_TEST_HELPER") {
+	case "listenfds":
+		serveListenFDs()
+	case "unix":
+		serveUnixSocket()
+	case "spawn":
+		// stands in for a gowd that starts an app and then goes away
+		if _, _, err := NewBackendPool().Select(os.Getenv("GOW_TEST_APP") + ".dev"); err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
+	}
+
+	var err error
+	Tempdir, err = ioutil.TempDir("", "gow-test")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	os.Setenv("HOME", Tempdir)
+	err = os.Mkdir(Tempdir+"/.pow", 0700)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestResourceUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource usage needs /proc")
+	}
+	err := os.Mkdir(Tempdir+"/.pow/app20", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app20/Procfile", []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo hello\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewBackendPool()
+	defer pool.Close()
+	_, release, err := pool.Select("app20.dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	// the first sample is taken right after booting
+	time.Sleep(200 * time.Millisecond)
+	for _, app := range pool.Status().Apps {
+		if app.Name != "app20" {
+			continue
+		}
+		if app.Usage == nil || app.Usage.Processes < 1 || app.Usage.RSS == 0 || app.Usage.Threads < 1 || app.Usage.FDs == 0 {
+			t.Fatal("expected resource usage to be reported, got", app.Usage)
+		}
+		return
+	}
+	t.Fatal("app20 is missing from the status")
+}
+
+func TestSetupRunsWhenLockFilesChange(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app21", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app21/Procfile", []byte("release: echo installing; echo ran >> setup.log\nweb: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo hello\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app21/Gemfile.lock", []byte("rails (7.0.0)\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs := func() int {
+		data, _ := ioutil.ReadFile(Tempdir + "/.pow/app21/setup.log")
+		return strings.Count(string(data), "ran")
+	}
+	spawn := func() {
+		b, err := SpawnBackend("app21")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Close()
+	}
+
+	spawn()
+	spawn()
+	if runs() != 1 {
+		t.Fatal("setup should have run once, but ran", runs(), "times")
+	}
+
+	err = ioutil.WriteFile(Tempdir+"/.pow/app21/Gemfile.lock", []byte("rails (7.1.0)\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spawn()
+	if runs() != 2 {
+		t.Fatal("setup should have run again after Gemfile.lock changed, but ran", runs(), "times")
+	}
+
+	// a failing setup keeps the app from starting, and shows up as a crash
+	err = ioutil.WriteFile(Tempdir+"/.pow/app21/Gemfile.lock", []byte("rails (7.2.0)\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app21.setup]\ncommand = \"echo missing gems; exit 1\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+	_, err = SpawnBackend("app21")
+	crash, ok := err.(BootCrash)
+	if !ok || !strings.Contains(string(crash.Log), "missing gems") {
+		t.Fatal("expected a boot crash with the setup output, got", err)
+	}
+}
+
+func TestConfigCheckedBeforeSetup(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app33", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app33/Procfile", []byte("release: touch setup-ran\nweb: sleep 60\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app33/.gow.toml", []byte("balance = \"fastest\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SpawnBackend("app33")
+	if err == nil || !strings.Contains(err.Error(), "fastest") {
+		t.Fatal("expected an error about the balance strategy, got", err)
+	}
+	if _, err := os.Stat(Tempdir + "/.pow/app33/setup-ran"); err == nil {
+		t.Fatal("setup should not have run with a broken config")
+	}
+}
+
+func TestLayeredEnv(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app22", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"/.pow/.env":                   "A=global\nB=global\nC=global\nD=global\nE=global\n",
+		"/.pow/app22/.env":             "B=env\nC=env\nD=env\nE=env\n",
+		"/.pow/app22/.env.development": "C=development\nD=development\nE=development\n",
+		"/.pow/app22/.env.local":       "D=local\nE=local\n",
+		"/.pow/.gow.toml":              "[apps.app22.env]\nE = \"config\"\n",
+		"/.pow/app22/Procfile":         "web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo; echo hello\"\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(Tempdir+name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Remove(Tempdir + "/.pow/.env")
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	pool := NewBackendPool()
+	defer pool.Close()
+	w := httptest.NewRecorder()
+	NewControlHandler(pool).ServeHTTP(w, httptest.NewRequest("GET", "http://gow.dev/apps/app22/env", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatal("the environment of an app that isn't running should not be resolved, got", w.Code, w.Body.String())
+	}
+
+	if _, err := pool.backend("app22", nil); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	NewControlHandler(pool).ServeHTTP(w, httptest.NewRequest("GET", "http://gow.dev/apps/app22/env", nil))
+	var vars []envVar
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	expected := map[string]string{"A": "global", "B": "env", "C": "development", "D": "local", "E": "config"}
+	for _, v := range vars {
+		if value, ok := expected[v.Name]; ok {
+			if v.Value != value {
+				t.Fatal(v.Name, "should have been", value, "but was", v.Value, "from", v.Source)
+			}
+			delete(expected, v.Name)
+		}
+	}
+	if len(expected) != 0 {
+		t.Fatal("missing variables:", expected)
+	}
+}
+
+func TestPowScripts(t *testing.T) {
+	err := os.Mkdir(Tempdir+"/.pow/app23", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app23/.powrc", []byte("export GREETING=hello\necho sourcing powrc\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app23/.powenv", []byte("export GREETING=\"$GREETING world\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app23/Procfile", []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo $GREETING\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SpawnBackend("app23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + b.Address() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	b.Close()
+	if strings.TrimSpace(string(body)) != "hello world" {
+		t.Fatal("expected the environment from .powrc and .powenv, got", string(body))
+	}
+
+	err = ioutil.WriteFile(Tempdir+"/.pow/app23/.powenv", []byte("echo no such version; false\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SpawnBackend("app23")
+	crash, ok := err.(BootCrash)
+	if !ok || !strings.Contains(string(crash.Log), "no such version") {
+		t.Fatal("expected a boot crash with the script's output, got", err)
+	}
+
+	// a process left running in the background doesn't hold up the spawn
+	err = ioutil.WriteFile(Tempdir+"/.pow/app23/.powenv", []byte("sleep 30 &\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	b, err = SpawnBackend("app23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if time.Since(started) > 10*time.Second {
+		t.Fatal("spawning waited for the background process, took", time.Since(started))
+	}
+}
+
+func TestToolchainsFromVersionFiles(t *testing.T) {
+	for _, dir := range []string{"/.rbenv/versions/3.2.2/bin", "/.nvm/versions/node/v18.17.1/bin", "/.nvm/versions/node/v18.9.0/bin"} {
+		if err := os.MkdirAll(Tempdir+dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Mkdir(Tempdir+"/.pow/app24", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app24/.ruby-version", []byte("3.2.2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app24/.nvmrc", []byte("v18\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars, err := resolvedEnv("app24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vars {
+		if v.Name == "PATH" && !strings.HasPrefix(v.Value, Tempdir+"/.rbenv/versions/3.2.2/bin:"+Tempdir+"/.nvm/versions/node/v18.17.1/bin:") {
+			t.Fatal("PATH should lead to the selected versions, but was", v.Value)
+		}
+	}
+
+	err = ioutil.WriteFile(Tempdir+"/.pow/app24/.tool-versions", []byte("ruby 3.3.0 # not installed\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = resolvedEnv("app24")
+	if err == nil || !strings.Contains(err.Error(), "ruby 3.3.0 is required by .tool-versions, but isn't installed") {
+		t.Fatal("expected an error about the missing version, got", err)
+	}
+
+	// system versions and tools without a version manager leave PATH alone,
+	// nvm aliases are followed to the version they stand for
+	if err := os.MkdirAll(Tempdir+"/.nvm/alias/lts", 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.nvm/alias/lts/*", []byte("lts/hydrogen\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.nvm/alias/lts/hydrogen", []byte("v18.9.0\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app24/.tool-versions", []byte("ruby system\nnodejs lts/*\ngolang 1.21.0\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err = resolvedEnv("app24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vars {
+		if v.Name == "PATH" && (!strings.HasPrefix(v.Value, Tempdir+"/.nvm/versions/node/v18.9.0/bin:") || strings.Contains(v.Value, ".rbenv")) {
+			t.Fatal("PATH should only lead to the aliased node version, but was", v.Value)
+		}
+	}
+}
+
+func TestLauncher(t *testing.T) {
+	words, err := splitWords(`run --name "$APP \"quoted\"" 'single $APP' ${APP}x back\ slash`, []string{"APP=myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"run", "--name", `myapp "quoted"`, "single $APP", "myappx", "back slash"}
+	if fmt.Sprint(words) != fmt.Sprint(expected) {
+		t.Fatal("expected", expected, "but got", words)
+	}
+
+	err = os.Mkdir(Tempdir+"/.pow/app25", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app25/Procfile", []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo \\$WRAPPED \\$FROM_DIRENV\"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stands in for direnv, which has to be found in the app's PATH
+	err = os.MkdirAll(Tempdir+"/bin", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/bin/direnv", []byte("#!/bin/sh\necho '{\"FROM_DIRENV\": \"envrc\", \"DIRENV_DIFF\": \"x\"}'\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.path", []byte(Tempdir+"/bin:"+os.Getenv("PATH")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.path")
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app25.launcher]\nshell = \"none\"\nwrapper = \"env WRAPPED=wrapped\"\ndirenv = true\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+
+	b, err := SpawnBackend("app25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	resp, err := http.Get("http://" + b.Address() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if strings.TrimSpace(string(body)) != "wrapped envrc" {
+		t.Fatal("expected the environment from the wrapper and direnv, got", string(body))
+	}
+}
+
+func TestDiscoveryVariables(t *testing.T) {
+	for _, name := range []string{"app26", "my-api", "database"} {
+		if err := os.Mkdir(Tempdir+"/.pow/"+name, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Remove(Tempdir + "/.pow/database")
+	// gowd's own settings win over the URLs of apps that happen to be named
+	// like them, and are interpolated whatever they contain
+	defer os.Unsetenv("DATABASE_URL")
+	os.Setenv("DATABASE_URL", "postgres://localhost/app26")
+	defer os.Unsetenv("GREETING")
+	os.Setenv("GREETING", "it's\nme")
+	err := ioutil.WriteFile(Tempdir+"/.pow/app26/.env", []byte("CALLBACK_URL=${GOW_URL}/auth/callback\nAPI=\"${MY_API_URL}/v1\"\nLITERAL='${GOW_URL}'\nHELLO=\"${GREETING}!\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars, err := resolvedEnv("app26")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"GOW_APP":      "app26",
+		"GOW_HOST":     "app26.dev",
+		"GOW_URL":      "http://app26.dev",
+		"MY_API_URL":   "http://my-api.dev",
+		"CALLBACK_URL": "http://app26.dev/auth/callback",
+		"API":          "http://my-api.dev/v1",
+		"LITERAL":      "${GOW_URL}",
+		"DATABASE_URL": "postgres://localhost/app26",
+		"HELLO":        "it's\nme!",
+	}
+	for _, v := range vars {
+		if value, ok := expected[v.Name]; ok {
+			if v.Value != value {
+				t.Fatal(v.Name, "should have been", value, "but was", v.Value)
+			}
+			delete(expected, v.Name)
+		}
+	}
+	if len(expected) != 0 {
+		t.Fatal("missing variables:", expected)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	if err := os.Mkdir(Tempdir+"/.pow/app27", 0700); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(Tempdir+"/.pow/app27/.env", []byte("SECRET=placeholder\nLOCAL=1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Setenv("EDITOR", os.Getenv("EDITOR"))
+	os.Setenv("EDITOR", `sh -c 'echo "SECRET=hunter2" >> "$1"' editor`)
+	if err := runSecrets([]string{"edit", "app27"}); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadFile(Tempdir + "/.pow/app27/.env.enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(sealed), "hunter2") {
+		t.Fatal(".env.enc isn't encrypted:", string(sealed))
+	}
+
+	vars, err := resolvedEnv("app27")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, v := range vars {
+		if v.Name == "SECRET" {
+			found = true
+			if v.Value != "hunter2" || v.Source != ".env.enc" {
+				t.Fatal("SECRET should have come from .env.enc, but was", v)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("SECRET is missing")
+	}
+
+	// an editor that changes nothing leaves the file alone
+	os.Setenv("EDITOR", "true")
+	if err := runSecrets([]string{"edit", "app27"}); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged, _ := ioutil.ReadFile(Tempdir + "/.pow/app27/.env.enc"); string(unchanged) != string(sealed) {
+		t.Fatal(".env.enc was rewritten without changes")
+	}
+
+	// without the key, the secrets can't be read
+	if err := os.Rename(keyPath(), keyPath()+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Rename(keyPath()+".bak", keyPath())
+	if _, err := resolvedEnv("app27"); err == nil || !strings.Contains(err.Error(), "no key") {
+		t.Fatal("expected an error about the missing key, got", err)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	if err := os.Mkdir(Tempdir+"/.pow/app28", 0700); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(Tempdir+"/.pow/app28/.env", []byte("API_TOKEN=tok-12345\nDB_PASSWORD=hunter22\nPLAIN=visible\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app28/Procfile", []byte("web: echo connecting with $API_TOKEN; exit 1\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = SpawnBackend("app28")
+	crash, ok := err.(BootCrash)
+	if !ok {
+		t.Fatal("expected a boot crash, got", err)
+	}
+	if strings.Contains(string(crash.Log), "tok-12345") || !strings.Contains(string(crash.Log), "connecting with [REDACTED]") {
+		t.Fatal("the token should have been redacted from the log:", string(crash.Log))
+	}
+	env := strings.Join(crash.Env, "\n")
+	for _, expected := range []string{"API_TOKEN=[REDACTED]", "DB_PASSWORD=[REDACTED]", "PLAIN=visible"} {
+		if !strings.Contains(env, expected) {
+			t.Fatal("expected", expected, "in the crash's environment:", env)
+		}
+	}
+	if strings.Contains(env, "HOME=") {
+		t.Fatal("variables inherited from gowd should have been left out:", env)
+	}
+
+	vars, err := resolvedEnv("app28")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vars {
+		if v.Name == "DB_PASSWORD" && v.Value != "[REDACTED]" {
+			t.Fatal("DB_PASSWORD should have been redacted, but was", v.Value)
+		}
+	}
+}
+
+func TestAppConfigFile(t *testing.T) {
+	if err := os.Mkdir(Tempdir+"/.pow/app29", 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"/.pow/app29/.gow.toml":    "web_process = \"server\"\nprocfile = \"Procfile.gow\"\nrestart_file = \"restart.now\"\nhostnames = [\"app29-alias.dev\"]\n\n[env]\nGREETING = \"from .gow.toml\"\n",
+		"/.pow/app29/Procfile.gow": "server: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo $GREETING\"\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(Tempdir+name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool := NewBackendPool()
+	defer pool.Close()
+	handler := makeProxyHandlerFunc(pool, nil)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://app29-alias.dev/", nil))
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != "from .gow.toml" {
+		t.Fatal("expected app29 to respond under its alias, got", w.Code, w.Body.String())
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := ioutil.WriteFile(Tempdir+"/.pow/app29/restart.now", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(Tempdir+"/.pow/app29/restart.now", later, later)
+	if reason := pool.backends["app29"].RestartReason(); reason != "restart.now touched" {
+		t.Fatal("expected touching restart.now to restart the app, got", reason)
+	}
+
+	// mistakes are pointed out rather than ignored
+	err := ioutil.WriteFile(Tempdir+"/.pow/app29/.gow.toml", []byte("web_proces = \"server\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SpawnBackend("app29")
+	if _, ok := err.(ConfigError); !ok || !strings.Contains(err.Error(), "web_proces") {
+		t.Fatal("expected a config error about web_proces, got", err)
+	}
+	w = httptest.NewRecorder()
+	writeErrorPage(w, err)
+	if !strings.Contains(w.Body.String(), "configuration is invalid") {
+		t.Fatal("expected an error page about the configuration, got", w.Body.String())
+	}
+
+	// an app's own config has no apps table
+	err = ioutil.WriteFile(Tempdir+"/.pow/app29/.gow.toml", []byte("[apps.app29]\nidle_timeout = \"1m\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAppConfig("app29"); err == nil || !strings.Contains(err.Error(), "apps.app29.idle_timeout") {
+		t.Fatal("expected a config error about the apps table, got", err)
+	}
+
+	// in ~/.pow/.gow.toml too, globally and for each app
+	if err := os.Remove(Tempdir + "/.pow/app29/.gow.toml"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(Tempdir + "/.pow/.gow.toml")
+	for _, config := range []string{"idle_timeot = \"1m\"\n", "[apps.app29]\nidle_timeout = \"1m\"\n\n[apps.app29.readyness]\ncheck = \"http\"\n"} {
+		err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte(config), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadAppConfig("app29")
+		if _, ok := err.(ConfigError); !ok || !strings.Contains(err.Error(), "Unknown setting") {
+			t.Fatal("expected a config error about the unknown setting, got", err)
+		}
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/.gow.toml", []byte("[apps.app29]\nidle_timeout = \"1m\"\n\n[apps.app29.env]\nA = \"1\"\n\n[apps.other]\nbalance = \"least-conn\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAppConfig("app29"); err != nil {
+		t.Fatal("valid settings should have been accepted, got", err)
+	}
+}
+
+func TestChooseProcfile(t *testing.T) {
+	if err := os.Mkdir(Tempdir+"/.pow/app30", 0700); err != nil {
+		t.Fatal(err)
+	}
+	server := func(greeting string) []byte {
+		return []byte("web: socat TCP-LISTEN:$PORT,crlf,fork SYSTEM:\"echo HTTP/1.1 200 OK; echo Content-Type\\: text/plain; echo; echo " + greeting + "\"\n")
+	}
+	files := map[string][]byte{
+		"Procfile":       []byte("web: puma -e production\n"),
+		"Procfile.dev":   server("dev"),
+		"Procfile.local": server("local"),
+		"Procfile.crash": []byte("web: exit 1\n"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(Tempdir+"/.pow/app30/"+name, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func() string {
+		b, err := SpawnBackend("app30")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		resp, err := http.Get("http://" + b.Address() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return strings.TrimSpace(string(body))
+	}
+
+	if greeting := get(); greeting != "dev" {
+		t.Fatal("expected Procfile.dev to be preferred, got", greeting)
+	}
+	err := ioutil.WriteFile(Tempdir+"/.pow/app30/.gow.toml", []byte("procfile = \"Procfile.crash\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SpawnBackend("app30")
+	if crash, ok := err.(BootCrash); !ok || crash.Procfile != "Procfile.crash" {
+		t.Fatal("expected a crash of Procfile.crash, got", err)
+	}
+	if err := ioutil.WriteFile(Tempdir+"/.pow/app30/.env", []byte("GOW_PROCFILE=Procfile.local\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if greeting := get(); greeting != "local" {
+		t.Fatal("expected GOW_PROCFILE to win, got", greeting)
+	}
+
+	// names of files the app doesn't have are passed over
+	if err := ioutil.WriteFile(Tempdir+"/.pow/app30/.env", []byte("GOW_PROCFILE=Procfile.missing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(Tempdir+"/.pow/app30/.gow.toml", []byte("procfile = \"Procfile.gone\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if greeting := get(); greeting != "dev" {
+		t.Fatal("expected to fall back to Procfile.dev, got", greeting)
+	}
+}
+
+func TestProcfileDiagnostics(t *testing.T) {
+	procfile := "# the app\n\nweb: bundle exec rails s -p $PORT\nweb : rails s\nworker sidekiq\nweb.2: puma\nclock:\nweb: puma\nassets-watch: yarn build --watch\r\n"
+	_, err := parseProcfile(strings.NewReader(procfile))
+	pfErr, ok := err.(ProcfileError)
+	if !ok {
+		t.Fatal("expected a ProcfileError, got", err)
+	}
+	expected := []procfileProblem{
+		{4, "web : rails s", "The process name must start the line and be followed by the colon right away", "web: rails s"},
+		{5, "worker sidekiq", "There's no colon after the process name", "worker: sidekiq"},
+		{6, "web.2: puma", "Process names may only contain letters, digits, _ and -", "web_2: puma"},
+		{7, "clock:", "clock has no command", ""},
+		{8, "web: puma", "web is already defined on line 3", ""},
+	}
+	if len(pfErr.Problems) != len(expected) {
+		t.Fatal("expected", len(expected), "problems, got", pfErr.Problems)
+	}
+	for i, p := range pfErr.Problems {
+		if p != expected[i] {
+			t.Fatal("expected", expected[i], "got", p)
+		}
+	}
+
+	pf, err := parseProcfile(strings.NewReader("# comment\nweb: puma\n\nassets-watch: yarn build --watch\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pf.Entries) != 2 || pf.Entries[1] != (ProcfileEntry{"assets-watch", "yarn build --watch"}) {
+		t.Fatal("unexpected entries:", pf.Entries)
+	}
+
+	w := httptest.NewRecorder()
+	writeErrorPage(w, pfErr)
+	if !strings.Contains(w.Body.String(), "did you mean:") || !strings.Contains(w.Body.String(), "worker: sidekiq") {
+		t.Fatal("expected the error page to show suggestions, got", w.Body.String())
+	}
 }
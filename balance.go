@@ -0,0 +1,45 @@
+package main
+
+import "sync/atomic"
+
+func validBalance(strategy string) bool {
+	return strategy == "round-robin" || strategy == "least-conn"
+}
+
+// Acquire picks the web process that should handle the next request and
+// returns its address. release must be called once the request is done.
+func (b *Backend) Acquire() (address string, release func()) {
+	inst := b.pick()
+	atomic.AddInt32(&inst.active, 1)
+	return b.instanceAddress(inst), func() {
+		atomic.AddInt32(&inst.active, -1)
+	}
+}
+
+func (b *Backend) pick() *instance {
+	var up []*instance
+	b.mtx.Lock()
+	for _, inst := range b.instances {
+		if inst.up {
+			up = append(up, inst)
+		}
+	}
+	b.mtx.Unlock()
+	if len(up) == 0 {
+		// nothing is in rotation right now, so the first one is as good as any
+		return b.instances[0]
+	}
+
+	if b.balance == "least-conn" {
+		best := up[0]
+		for _, inst := range up[1:] {
+			if atomic.LoadInt32(&inst.active) < atomic.LoadInt32(&best.active) {
+				best = inst
+			}
+		}
+		return best
+	}
+
+	n := atomic.AddUint32(&b.next, 1)
+	return up[int(n-1)%len(up)]
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// bootEventsPath is served by gow itself on every app's host. It streams the
+// output of a booting app to the boot page.
+const bootEventsPath = "/__gow/boot-events"
+
+// BackgroundBooter is implemented by selectors that can boot an app without
+// blocking the request, so that browsers can be shown the boot page meanwhile.
+type BackgroundBooter interface {
+	// Booting returns the boot in progress for the host's app, starting one if
+	// necessary, or nil if the app can serve requests right away.
+	Booting(requestHost string) *bootProgress
+}
+
+// bootProgress follows an app that is booting in the background.
+type bootProgress struct {
+	log  *bootLog
+	done chan struct{}
+	err  error // valid once done is closed
+}
+
+func (b *bootProgress) finished() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wantsBootPage tells whether the request comes from a browser navigating to
+// the app. Everything else, including fetch() and the like asking for HTML,
+// waits for the app to boot, like it always did.
+func wantsBootPage(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	// browsers that send these tell us exactly what the request is for
+	if dest := r.Header.Get("Sec-Fetch-Dest"); dest != "" {
+		return dest == "document"
+	}
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func writeBootPage(w http.ResponseWriter, r *http.Request) {
+	w.Header()["Content-Type"] = []string{"text/html"}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(503)
+
+	name := html.EscapeString(appForHost(r.Host))
+	w.Write([]byte("<h1>Starting " + name + "&hellip;</h1>"))
+	w.Write([]byte("<blockquote><pre id=log></pre></blockquote>"))
+	w.Write([]byte(ansiFilterScript))
+	w.Write([]byte(bootPageScript))
+}
+
+// serveBootEvents streams the boot output as server-sent events, each holding
+// a JSON-encoded chunk of it, followed by a "ready" or "failed" event.
+func serveBootEvents(w http.ResponseWriter, r *http.Request, boot *bootProgress) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if boot == nil {
+		fmt.Fprint(w, "event: ready\ndata:\n\n")
+		return
+	}
+
+	sent := 0
+	for {
+		changed := boot.log.Changed()
+		finished := boot.finished()
+
+		output := boot.log.Bytes()
+		if len(output) > sent {
+			data, _ := json.Marshal(string(output[sent:]))
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			sent = len(output)
+		}
+		if finished {
+			if boot.err != nil {
+				fmt.Fprint(w, "event: failed\ndata:\n\n")
+			} else {
+				fmt.Fprint(w, "event: ready\ndata:\n\n")
+			}
+			flush()
+			return
+		}
+		flush()
+
+		select {
+		case <-changed:
+		case <-boot.done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// bootPageScript appends the boot output to #log as it arrives, and reloads
+// the page once the app is up (or has crashed, which shows the crash page).
+var bootPageScript = `<script>
+var el = document.getElementById("log")
+var filter = new Filter({stream: true})
+var source = new EventSource("` + bootEventsPath + `")
+source.onmessage = function(e) {
+  var text = JSON.parse(e.data).replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;")
+  el.innerHTML += filter.toHtml(text)
+  window.scrollTo(0, document.body.scrollHeight)
+}
+var reload = function() {
+  source.close()
+  location.reload()
+}
+source.addEventListener("ready", reload)
+source.addEventListener("failed", reload)
+</script>`
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// bootLog captures the output of a process, while passing it on to tee
+// (usually gowd's own log). It may be read while the process is still
+// writing to it. Secrets are redacted from both.
+type bootLog struct {
+	tee    io.Writer
+	redact *redactor
+
+	mtx     sync.Mutex
+	buf     bytes.Buffer
+	changed chan struct{}
+	closed  bool
+}
+
+func (l *bootLog) Write(p []byte) (int, error) {
+	n := len(p)
+	p = l.redact.redact(p)
+	if l.tee != nil {
+		l.tee.Write(p)
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return n, nil
+	}
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+	l.buf.Write(p)
+	return n, nil
+}
+
+// newBootLog returns a log that passes output on to gowd's log (never to its
+// stdout), and to bootOutput, if given.
+func newBootLog(bootOutput io.Writer, redact *redactor) *bootLog {
+	if bootOutput != nil {
+		return &bootLog{tee: io.MultiWriter(os.Stderr, bootOutput), redact: redact}
+	}
+	return &bootLog{tee: os.Stderr, redact: redact}
+}
+
+// Bytes returns a copy of everything written so far.
+func (l *bootLog) Bytes() []byte {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return append([]byte(nil), l.buf.Bytes()...)
+}
+
+// Close stops the log from recording any further output.
+func (l *bootLog) Close() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.closed = true
+}
+
+// Changed returns a channel that is closed on the next write.
+func (l *bootLog) Changed() <-chan struct{} {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	return l.changed
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroup is the cgroup v2 subtree that all processes of a backend run in.
+type cgroup struct {
+	path string
+	dir  *os.File
+}
+
+var cgroupParent struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// parentCgroup returns the cgroup below which gowd creates the cgroups of its
+// apps: the one it was started in, with the memory and cpu controllers
+// enabled for its children.
+func parentCgroup() (string, error) {
+	cgroupParent.once.Do(func() {
+		cgroupParent.path, cgroupParent.err = setupParentCgroup()
+	})
+	return cgroupParent.path, cgroupParent.err
+}
+
+func setupParentCgroup() (string, error) {
+	if _, err := os.Stat(cgroupRoot + "/cgroup.controllers"); err != nil {
+		return "", errors.New("cgroup v2 is not mounted at " + cgroupRoot)
+	}
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	own := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			own = strings.TrimPrefix(line, "0::")
+		}
+	}
+	if own == "" {
+		return "", errors.New("gowd is not in a cgroup v2 hierarchy")
+	}
+	parent := filepath.Join(cgroupRoot, own)
+
+	enable := []byte("+memory +cpu")
+	if err := ioutil.WriteFile(parent+"/cgroup.subtree_control", enable, 0644); err == nil {
+		return parent, nil
+	}
+	// only cgroups without processes of their own can hand out resources to
+	// children, so move gowd out of the way first
+	leaf := parent + "/gowd"
+	if err := os.MkdirAll(leaf, 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(leaf+"/cgroup.procs", []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(parent+"/cgroup.subtree_control", enable, 0644); err != nil {
+		return "", err
+	}
+	return parent, nil
+}
+
+func createCgroup(name string, limits LimitsConfig) (*cgroup, error) {
+	parent, err := parentCgroup()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(parent, "app-"+name+"-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, err
+	}
+	c, err := openCgroup(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	if limits.Memory != "" {
+		size, _ := parseSize(limits.Memory)
+		if err := c.write("memory.max", strconv.FormatInt(size, 10)); err != nil {
+			c.remove()
+			return nil, err
+		}
+		// swapping out would only postpone hitting the limit, slowly
+		c.write("memory.swap.max", "0")
+	}
+	if limits.CPU != 0 {
+		period := 100000
+		quota := int(limits.CPU * float64(period))
+		if err := c.write("cpu.max", strconv.Itoa(quota)+" "+strconv.Itoa(period)); err != nil {
+			c.remove()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// openCgroup opens an existing cgroup, e.g. one of an adopted backend.
+func openCgroup(path string) (*cgroup, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &cgroup{path: path, dir: dir}, nil
+}
+
+func (c *cgroup) write(file, value string) error {
+	return ioutil.WriteFile(filepath.Join(c.path, file), []byte(value), 0644)
+}
+
+// apply has a process be started right in the cgroup, so that nothing it
+// forks early on escapes it.
+func (c *cgroup) apply(attr *syscall.SysProcAttr) {
+	if c == nil {
+		return
+	}
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(c.dir.Fd())
+}
+
+// oomKills returns how many processes the kernel killed for exceeding the
+// cgroup's memory limit.
+func (c *cgroup) oomKills() int {
+	if c == nil {
+		return 0
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.path, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// remove deletes the cgroup once the processes in it are gone.
+func (c *cgroup) remove() {
+	if c == nil {
+		return
+	}
+	c.dir.Close()
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(c.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Println("failed to remove cgroup", c.path, "-", err)
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// cgroup is the cgroup v2 subtree that all processes of a backend run in.
+// There are no cgroups outside of Linux.
+type cgroup struct {
+	path string
+}
+
+var errNoCgroups = errors.New("cgroups are only available on Linux")
+
+func createCgroup(name string, limits LimitsConfig) (*cgroup, error) {
+	return nil, errNoCgroups
+}
+
+func openCgroup(path string) (*cgroup, error) {
+	return nil, errNoCgroups
+}
+
+func (c *cgroup) apply(attr *syscall.SysProcAttr) {}
+
+func (c *cgroup) oomKills() int {
+	return 0
+}
+
+func (c *cgroup) remove() {}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config is read from ~/.pow/.gow.toml. Settings at the top level apply to
+// all apps, and can be overridden for a single app in an [apps.<name>] table:
+//
+//	formation = "web=1"
+//	prewarm = ["myapp"]
+//
+//	[apps.myapp]
+//	formation = "web=1 worker=2"
+//
+// An app can also come with a .gow.toml of its own, which holds the same
+// settings as an [apps.<name>] table. That table still has the last word.
+type Config struct {
+	AppConfig
+	Apps map[string]toml.Primitive `toml:"apps"`
+
+	// Prewarm lists apps to boot as soon as gowd starts, at most
+	// PrewarmParallelism at a time.
+	Prewarm            []string `toml:"prewarm"`
+	PrewarmParallelism int      `toml:"prewarm_parallelism"`
+
+	meta toml.MetaData
+}
+
+// AppConfig holds the settings that can be made per app.
+type AppConfig struct {
+	// Formation lists how many processes of each Procfile entry to run, in
+	// foreman's syntax: "web=1 worker=2", or "all=1" for one of everything.
+	Formation string `toml:"formation"`
+
+	// Balance is how requests are spread across multiple web processes:
+	// "round-robin" or "least-conn".
+	Balance string `toml:"balance"`
+
+	// IdleTimeout is how long an app may go without requests before it is
+	// stopped. "never" keeps it running until gowd exits.
+	IdleTimeout Duration `toml:"idle_timeout"`
+
+	// BootTimeout is how long a web process may take to become ready.
+	BootTimeout Duration `toml:"boot_timeout"`
+
+	// WebProcess is the Procfile entry that serves requests.
+	WebProcess string `toml:"web_process"`
+
+	// Procfile is read from the app's directory. By default, that's
+	// Procfile.dev if there is one, and Procfile otherwise. GOW_PROCFILE in
+	// the app's environment, e.g. from its .env, wins over this.
+	Procfile string `toml:"procfile"`
+
+	// RestartFile restarts the app when touched. It is relative to the
+	// app's directory.
+	RestartFile string `toml:"restart_file"`
+
+	// Hostnames are more names the app can be reached under, besides
+	// <name>.dev and its subdomains.
+	Hostnames []string `toml:"hostnames"`
+
+	// UnixSocket has web processes listen on a Unix socket, whose path is
+	// passed in $SOCKET and $GOW_SOCKET, instead of a TCP port.
+	UnixSocket bool `toml:"unix_socket"`
+
+	// SocketActivation passes web processes a listening socket, following
+	// systemd's LISTEN_FDS protocol.
+	SocketActivation bool `toml:"socket_activation"`
+
+	// PortDiscovery routes requests to whatever port the app listens on,
+	// for apps that hardcode it instead of using $PORT.
+	PortDiscovery bool `toml:"port_discovery"`
+
+	// While the app boots or restarts, up to HoldQueue requests wait for it.
+	// Waiting for a restart takes at most HoldTimeout. Others are answered
+	// with a 503.
+	HoldQueue   int      `toml:"hold_queue"`
+	HoldTimeout Duration `toml:"hold_timeout"`
+
+	Readiness ReadinessConfig `toml:"readiness"`
+	Liveness  LivenessConfig  `toml:"liveness"`
+	Limits    LimitsConfig    `toml:"limits"`
+	Setup     SetupConfig     `toml:"setup"`
+	Launcher  LauncherConfig  `toml:"launcher"`
+
+	// Toolchains has the app's PATH lead to the Ruby, Node, Go etc. versions
+	// its version files ask for, as installed by asdf, rbenv, nodenv or nvm.
+	Toolchains bool `toml:"toolchains"`
+
+	// Env is added to the app's environment, overriding its .env files.
+	Env map[string]string `toml:"env"`
+	// the config file each variable of Env comes from
+	envSources map[string]string
+
+	// Redact lists patterns like "*_TOKEN" for the names of variables whose
+	// values are kept off crash pages and out of logs.
+	Redact []string `toml:"redact"`
+}
+
+var defaultAppConfig = AppConfig{
+	Formation:   "web=1",
+	Balance:     "round-robin",
+	IdleTimeout: Duration{30 * time.Minute},
+	BootTimeout: Duration{30 * time.Second},
+	WebProcess:  "web",
+	RestartFile: "tmp/restart.txt",
+	HoldQueue:   100,
+	HoldTimeout: Duration{1 * time.Minute},
+	Readiness:   defaultReadinessConfig,
+	Liveness:    defaultLivenessConfig,
+	Setup:       defaultSetupConfig,
+	Toolchains:  true,
+	Launcher:    defaultLauncherConfig,
+	Redact:      defaultRedactPatterns,
+}
+
+// Duration is a time.Duration that is written as e.g. "90s" or "30m" in the
+// config file. "never" is stored as zero, which disables the timeout.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	if string(text) == "never" {
+		d.Duration = 0
+		return nil
+	}
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	if d.Duration == 0 {
+		return []byte("never"), nil
+	}
+	return []byte(d.Duration.String()), nil
+}
+
+func configPath() string {
+	return os.Getenv("HOME") + "/.pow/.gow.toml"
+}
+
+// appConfigFile is the name of an app's own config file.
+const appConfigFile = ".gow.toml"
+
+// ConfigError is a config file that can't be used. It gets a page of its own,
+// rather than gow carrying on with some settings missing.
+type ConfigError struct {
+	Path    string
+	Section string // e.g. "apps.myapp", if the problem is limited to that
+	Err     error
+}
+
+func (e ConfigError) Error() string {
+	if e.Section != "" {
+		return fmt.Sprintf("Reading [%s] in %s: %s", e.Section, e.Path, e.Err)
+	}
+	return fmt.Sprintf("Reading %s: %s", e.Path, e.Err)
+}
+
+// LoadConfig reads the global configuration. A missing file is fine and
+// results in the defaults.
+func LoadConfig() (*Config, error) {
+	cfg := &Config{AppConfig: defaultAppConfig, PrewarmParallelism: 2}
+	meta, err := toml.DecodeFile(configPath(), cfg)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, ConfigError{Path: configPath(), Err: err}
+	}
+	if err := unknownSettings(meta, true); err != nil {
+		return nil, ConfigError{Path: configPath(), Err: err}
+	}
+	cfg.meta = meta
+	return cfg, nil
+}
+
+// App returns the effective settings for the named app.
+func (c *Config) App(name string) (AppConfig, error) {
+	app := c.AppConfig
+	// the app's env adds to the global one, which must stay as it is
+	app.Env = make(map[string]string)
+	app.envSources = make(map[string]string)
+	for k, v := range c.Env {
+		app.Env[k] = v
+		app.envSources[k] = configPath()
+	}
+
+	// proxy files have no directory, and thus no config file of their own
+	if pathToApp, err := appDir(name); err == nil && isDir(pathToApp) {
+		path := filepath.Join(pathToApp, appConfigFile)
+		meta, err := toml.DecodeFile(path, &app)
+		if err != nil && !os.IsNotExist(err) {
+			return app, ConfigError{Path: path, Err: err}
+		}
+		if err := unknownSettings(meta, false); err != nil {
+			return app, ConfigError{Path: path, Err: err}
+		}
+		app.addEnvSources(meta, nil, path)
+	}
+
+	if overrides, ok := c.Apps[name]; ok {
+		if err := c.meta.PrimitiveDecode(overrides, &app); err != nil {
+			return app, ConfigError{Path: configPath(), Section: "apps." + name, Err: err}
+		}
+		if err := unknownSettings(c.meta, true, "apps", name); err != nil {
+			return app, ConfigError{Path: configPath(), Section: "apps." + name, Err: err}
+		}
+		app.addEnvSources(c.meta, []string{"apps", name}, configPath())
+	}
+	return app, nil
+}
+
+// unknownSettings complains about the keys within prefix that don't belong to
+// any setting. In the global config, the apps table is left out, since each
+// app's section is only decoded when the app is looked up. An app's own config
+// has no such table, though.
+func unknownSettings(meta toml.MetaData, global bool, prefix ...string) error {
+	var unknown []string
+outer:
+	for _, key := range meta.Undecoded() {
+		if global && len(prefix) == 0 && key[0] == "apps" || len(key) < len(prefix) {
+			continue
+		}
+		for i := range prefix {
+			if key[i] != prefix[i] {
+				continue outer
+			}
+		}
+		unknown = append(unknown, key.String())
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Unknown setting %s", strings.Join(unknown, ", "))
+}
+
+// addEnvSources notes that the variables in the env table within prefix of a
+// config file came from path.
+func (c *AppConfig) addEnvSources(meta toml.MetaData, prefix []string, path string) {
+	for _, key := range meta.Keys() {
+		if len(key) != len(prefix)+2 || key[len(prefix)] != "env" {
+			continue
+		}
+		if strings.Join(key[:len(prefix)], ".") == strings.Join(prefix, ".") {
+			c.envSources[key[len(key)-1]] = path
+		}
+	}
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// validate checks the settings that aren't covered by a section of their own.
+func (c AppConfig) validate() error {
+	if c.WebProcess == "" || c.RestartFile == "" {
+		return errors.New("web_process and restart_file can't be empty")
+	}
+	for _, hostname := range c.Hostnames {
+		if !strings.HasSuffix(hostname, ".dev") {
+			return fmt.Errorf("Hostname %q doesn't end in .dev, so it would never reach gow", hostname)
+		}
+	}
+	return nil
+}
+
+// loadAppConfig is a shorthand for reading the global config and picking out
+// the settings for one app.
+func loadAppConfig(name string) (AppConfig, error) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return defaultAppConfig, err
+	}
+	return cfg.App(name)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The control interface is served on http://gow.dev/, which is thus reserved:
+// an app named gow is only reachable through its subdomains.
+//
+//	GET  /status.json       lists all running apps, their resource usage and the
+//	                        prewarming progress
+//	POST /apps/<name>/pin   keeps an app from idling out
+//	POST /apps/<name>/unpin reverts to the app's configured idle timeout
+//	GET  /apps/<name>/env   shows the environment the running app was started
+//	                        with, and where each variable comes from
+const controlAppName = "gow"
+
+type poolStatus struct {
+	Apps    []appStatus       `json:"apps"`
+	Prewarm map[string]string `json:"prewarm"`
+}
+
+type appStatus struct {
+	Name        string          `json:"name"`
+	Proxy       bool            `json:"proxy"`
+	Running     bool            `json:"running"`
+	Pinned      bool            `json:"pinned"`
+	IdleTimeout Duration        `json:"idle_timeout"`
+	StartedAt   time.Time       `json:"started_at"`
+	LastRestart *restartRecord  `json:"last_restart,omitempty"`
+	Processes   []processStatus `json:"processes"`
+
+	// Usage is the latest sample of UsageHistory, which covers the last hour.
+	Usage        *resourceUsage  `json:"usage,omitempty"`
+	UsageHistory []resourceUsage `json:"usage_history,omitempty"`
+}
+
+type processStatus struct {
+	Name   string `json:"name"`
+	Pid    int    `json:"pid,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Socket string `json:"socket,omitempty"`
+	Up     bool   `json:"up"`
+}
+
+// Status describes all apps the pool knows about.
+func (p *BackendPool) Status() poolStatus {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	prewarm := make(map[string]string)
+	for name, status := range p.prewarm {
+		prewarm[name] = status
+	}
+
+	statuses := []appStatus{}
+	for name, b := range p.backends {
+		b.mtx.Lock()
+		status := appStatus{Name: name, Proxy: b.proxy, Running: !b.exited, Pinned: p.pinned[name], IdleTimeout: Duration{b.idleTimeout}, StartedAt: b.startedAt}
+		if restart, ok := p.restarts[name]; ok {
+			status.LastRestart = &restart
+		}
+		for _, inst := range b.instances {
+			ps := processStatus{Name: inst.name, Port: inst.port, Socket: inst.path, Up: inst.up}
+			if inst.process != nil {
+				ps.Pid = inst.process.Pid
+			}
+			status.Processes = append(status.Processes, ps)
+		}
+		for _, w := range b.workers {
+			ps := processStatus{Name: w.name, Port: w.port, Up: !b.exited}
+			if w.process != nil {
+				ps.Pid = w.process.Pid
+			}
+			status.Processes = append(status.Processes, ps)
+		}
+		b.mtx.Unlock()
+		status.UsageHistory = b.Usage()
+		if n := len(status.UsageHistory); n > 0 {
+			status.Usage = &status.UsageHistory[n-1]
+		}
+		statuses = append(statuses, status)
+	}
+	return poolStatus{Apps: statuses, Prewarm: prewarm}
+}
+
+// Env returns the environment a running app was started with. It doesn't
+// resolve it anew, since that runs the app's scripts, which a mere GET
+// shouldn't.
+func (p *BackendPool) Env(name string) ([]envVar, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	b := p.backends[name]
+	switch {
+	case b == nil || b.Exited():
+		return nil, fmt.Errorf("%s isn't running", name)
+	case b.proxy:
+		return nil, fmt.Errorf("%s is a proxy, Gow doesn't start it", name)
+	case b.env == nil:
+		return nil, fmt.Errorf("%s was started by an earlier gowd, its environment is unknown", name)
+	}
+	return b.env, nil
+}
+
+func NewControlHandler(pool *BackendPool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pool.Status())
+	})
+	mux.HandleFunc("/apps/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/apps/"), "/")
+		if len(parts) != 2 || parts[0] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if parts[1] == "env" {
+			vars, err := pool.Env(parts[0])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(vars)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		switch parts[1] {
+		case "pin":
+			pool.Pin(parts[0], true)
+		case "unpin":
+			pool.Pin(parts[0], false)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
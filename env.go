@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// envFiles are read from the app's directory, later ones overriding earlier
+// ones: committed defaults first, personal overrides last.
+// .env.enc holds secrets, see secrets.go.
+var envFiles = []string{".env", ".env.development", encryptedEnvFile, ".env.local"}
+
+// powScripts are sourced in bash, in this order, like Pow did, e.g. to have
+// rbenv or nvm set up the environment.
+var powScripts = []string{".powrc", ".powenv"}
+
+// envVar is a variable of an app's environment, along with where it was set.
+type envVar struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// appEnv is an environment that is built up in layers.
+type appEnv struct {
+	vars  []envVar
+	index map[string]int
+}
+
+func (e *appEnv) set(name, value, source string) {
+	if e.index == nil {
+		e.index = make(map[string]int)
+	}
+	if i, ok := e.index[name]; ok {
+		e.vars[i] = envVar{name, value, source}
+		return
+	}
+	e.index[name] = len(e.vars)
+	e.vars = append(e.vars, envVar{name, value, source})
+}
+
+func (e *appEnv) unset(name string) {
+	i, ok := e.index[name]
+	if !ok {
+		return
+	}
+	e.vars = append(e.vars[:i], e.vars[i+1:]...)
+	delete(e.index, name)
+	for j := i; j < len(e.vars); j++ {
+		e.index[e.vars[j].Name] = j
+	}
+}
+
+// readFile adds the variables from a dotenv file. A missing file is fine.
+func (e *appEnv) readFile(path, source string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Reading %s: %s", source, err)
+	}
+	return e.readData(data, source)
+}
+
+// readData adds the variables from the contents of a dotenv file. Values can
+// refer to variables from earlier layers with ${NAME}.
+func (e *appEnv) readData(data []byte, source string) error {
+	own, err := godotenv.UnmarshalBytes(data)
+	if err != nil {
+		return fmt.Errorf("Reading %s: %s", source, err)
+	}
+
+	// godotenv only interpolates variables defined earlier in the same file,
+	// so put everything we have so far in front. Values can hold anything,
+	// quotes and newlines included, so each is stood in for by a placeholder
+	// that is swapped for the real value afterwards.
+	var prelude bytes.Buffer
+	var values []string
+	for i, v := range e.vars {
+		if envNamePattern.MatchString(v.Name) {
+			placeholder := fmt.Sprintf("<gow-value-%d>", i)
+			fmt.Fprintf(&prelude, "%s='%s'\n", v.Name, placeholder)
+			values = append(values, placeholder, v.Value)
+		}
+	}
+	entries, err := godotenv.UnmarshalBytes(append(prelude.Bytes(), data...))
+	if err != nil {
+		return fmt.Errorf("Reading %s: %s", source, err)
+	}
+	expand := strings.NewReplacer(values...)
+
+	names := make([]string, 0, len(own))
+	for name := range own {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e.set(name, expand.Replace(entries[name]), source)
+	}
+	return nil
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// setDiscovery adds the variables that tell an app where it and its siblings
+// can be reached: GOW_APP, GOW_HOST and GOW_URL for itself, and <NAME>_URL
+// for every app in ~/.pow. The latter don't override what's set already, so
+// that an app named "database" doesn't take over DATABASE_URL.
+func (e *appEnv) setDiscovery(appName string) {
+	entries, _ := ioutil.ReadDir(os.Getenv("HOME") + "/.pow")
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if _, ok := e.index[urlVariable(name)]; ok {
+			continue
+		}
+		e.set(urlVariable(name), appURL(name), "gow")
+	}
+	e.set("GOW_APP", appName, "gow")
+	e.set("GOW_HOST", appName+".dev", "gow")
+	e.set("GOW_URL", appURL(appName), "gow")
+}
+
+func appURL(appName string) string {
+	return "http://" + appName + ".dev"
+}
+
+// urlVariable names the variable holding an app's URL, e.g. MY_API_URL for
+// my-api.
+func urlVariable(appName string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, appName)
+	return name + "_URL"
+}
+
+// envReadGrace is how long the output of the scripts, and the environment,
+// are read after they exited.
+const envReadGrace = time.Second
+
+// sourceScripts runs the app's .powrc and .powenv in bash, and takes over the
+// environment they leave behind. Their output is passed on to output, and
+// shows up on the crash page if they fail.
+func (e *appEnv) sourceScripts(pathToApp string, timeout time.Duration, redact []string, output io.Writer) error {
+	var sources []string
+	for _, name := range powScripts {
+		if _, err := os.Stat(filepath.Join(pathToApp, name)); err == nil {
+			sources = append(sources, "source ./"+name)
+		}
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	script := strings.Join(sources, " && ")
+
+	// the resulting environment is written to fd 3, so that it doesn't get
+	// mixed up with whatever the scripts print
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// the secrets known so far, at least, are kept out of the transcript
+	transcript := &bootLog{tee: output, redact: newRedactor(e.List(), redact)}
+	cmd := exec.Command("bash", "-c", script+" && env -0 >&3")
+	cmd.Stdout = transcript
+	cmd.Stderr = transcript
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Dir = pathToApp
+	cmd.Env = e.List()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// a process the scripts leave in the background may hold on to their
+	// output, and to fd 3, long after they exited
+	cmd.WaitDelay = envReadGrace
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	result := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		result <- data
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+		if errors.Is(err, exec.ErrWaitDelay) {
+			err = nil
+		}
+	case <-timeoutChan(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	var data []byte
+	if err == nil {
+		// the environment has been written by now
+		r.SetReadDeadline(time.Now().Add(envReadGrace))
+		if data = <-result; len(data) == 0 {
+			err = errors.New("exited before the environment could be captured")
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(transcript, err)
+		return BootCrash{Log: transcript.Bytes(), Env: e.List(), Cmd: script, Path: pathToApp}
+	}
+
+	resulting := make(map[string]string)
+	for _, kv := range strings.Split(string(data), "\x00") {
+		if i := strings.Index(kv, "="); i > 0 {
+			resulting[kv[:i]] = kv[i+1:]
+		}
+	}
+	for _, v := range e.Vars() {
+		if _, ok := resulting[v.Name]; !ok {
+			e.unset(v.Name)
+		}
+	}
+	names := make([]string, 0, len(resulting))
+	for name := range resulting {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case "PWD", "OLDPWD", "SHLVL", "_":
+			continue // set by bash itself
+		}
+		if i, ok := e.index[name]; !ok || e.vars[i].Value != resulting[name] {
+			e.set(name, resulting[name], strings.Join(powScripts, "/"))
+		}
+	}
+	return nil
+}
+
+// Get returns the value of a variable, or "" if it isn't set.
+func (e *appEnv) Get(name string) string {
+	if i, ok := e.index[name]; ok {
+		return e.vars[i].Value
+	}
+	return ""
+}
+
+// List returns the environment in the form exec.Cmd expects.
+func (e *appEnv) List() []string {
+	env := make([]string, len(e.vars))
+	for i, v := range e.vars {
+		env[i] = v.Name + "=" + v.Value
+	}
+	return env
+}
+
+// Vars returns the variables sorted by name.
+func (e *appEnv) Vars() []envVar {
+	vars := append([]envVar(nil), e.vars...)
+	sort.Slice(vars, func(i, j int) bool {
+		return vars[i].Name < vars[j].Name
+	})
+	return vars
+}
+
+// resolveEnv builds the environment of an app's processes. In increasing order
+// of precedence, it is made up of:
+//
+//	gowd's own environment
+//	~/.pow/.path, which replaces PATH
+//	GOW_APP, GOW_HOST, GOW_URL and <APP>_URL for every app
+//	~/.pow/.env
+//	.env, .env.development, .env.enc and .env.local in the app's directory
+//	the toolchains from the app's version files, put in front of PATH
+//	whatever .powrc and .powenv in the app's directory export
+//	the app's .envrc, if the launcher is configured to use direnv
+//	env from the config file, globally and then for the app
+//
+// The output of .powrc and .powenv is written to output, if given.
+func resolveEnv(appName, pathToApp string, config AppConfig, output io.Writer) (*appEnv, error) {
+	env := new(appEnv)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env.set(kv[:i], kv[i+1:], "gowd")
+		}
+	}
+
+	if path, err := ioutil.ReadFile(os.Getenv("HOME") + "/.pow/.path"); err == nil {
+		env.set("PATH", string(path), "~/.pow/.path")
+	}
+	env.setDiscovery(appName)
+
+	if err := env.readFile(os.Getenv("HOME")+"/.pow/.env", "~/.pow/.env"); err != nil {
+		return nil, err
+	}
+	for _, name := range envFiles {
+		if name == encryptedEnvFile {
+			data, err := readEncryptedEnvFile(pathToApp + "/" + name)
+			if err != nil {
+				return nil, fmt.Errorf("Reading %s: %s", name, err)
+			}
+			if err := env.readData(data, name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := env.readFile(pathToApp+"/"+name, name); err != nil {
+			return nil, err
+		}
+	}
+	if config.Toolchains {
+		if err := env.selectToolchains(pathToApp); err != nil {
+			return nil, err
+		}
+	}
+	if err := env.sourceScripts(pathToApp, config.BootTimeout.Duration, config.Redact, output); err != nil {
+		return nil, err
+	}
+	if config.Launcher.Direnv {
+		if err := env.loadDirenv(pathToApp); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(config.Env))
+	for name := range config.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		source := config.envSources[name]
+		if source == "" {
+			source = configPath()
+		}
+		env.set(name, config.Env[name], source)
+	}
+	return env, nil
+}
+
+// redactVars replaces the values of secrets among vars.
+func redactVars(vars []envVar, patterns []string) []envVar {
+	for i, v := range vars {
+		if isSecret(v.Name, patterns) {
+			vars[i].Value = redactedValue
+		}
+	}
+	return vars
+}
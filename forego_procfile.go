@@ -8,9 +8,13 @@ import (
 	"math"
 	"os"
 	"regexp"
+	"strings"
 )
 
-var procfileEntryRegexp = regexp.MustCompile("^([A-Za-z0-9_]+):\\s*(.+)$")
+// Like with foreman and forego, an entry is a name, a colon and a command, all
+// on one line. Lines starting with # are comments.
+var procfileEntryRegexp = regexp.MustCompile("^([A-Za-z0-9_-]+):\\s*(.+)$")
+var procfileNameRegexp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
 
 type ProcfileEntry struct {
 	Name    string
@@ -21,13 +25,41 @@ type Procfile struct {
 	Entries []ProcfileEntry
 }
 
+// ProcfileError lists the lines of a Procfile that can't be used. Rather than
+// skipping them, like foreman does, we refuse to start the app, since a typo
+// would otherwise just lead to a missing process.
+type ProcfileError struct {
+	Path     string
+	Problems []procfileProblem
+}
+
+type procfileProblem struct {
+	Line       int
+	Text       string
+	Message    string
+	Suggestion string // the line as it was probably meant, if we can tell
+}
+
+func (e ProcfileError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = fmt.Sprintf("line %d: %s", p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s can't be used: %s", e.Path, strings.Join(problems, "; "))
+}
+
 func ReadProcfile(filename string) (*Procfile, error) {
 	fd, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer fd.Close()
-	return parseProcfile(fd)
+	pf, err := parseProcfile(fd)
+	if pfErr, ok := err.(ProcfileError); ok {
+		pfErr.Path = filename
+		return nil, pfErr
+	}
+	return pf, err
 }
 
 func (pf *Procfile) HasProcess(name string) (exists bool) {
@@ -58,15 +90,64 @@ func (pf *Procfile) LongestProcessName(concurrency map[string]int) (longest int)
 
 func parseProcfile(r io.Reader) (*Procfile, error) {
 	pf := new(Procfile)
+	var problems []procfileProblem
+	defined := make(map[string]int)
 	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		parts := procfileEntryRegexp.FindStringSubmatch(scanner.Text())
-		if len(parts) > 0 {
-			pf.Entries = append(pf.Entries, ProcfileEntry{parts[1], parts[2]})
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if trimmed := strings.TrimSpace(text); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		parts := procfileEntryRegexp.FindStringSubmatch(text)
+		if len(parts) == 0 || strings.TrimSpace(parts[2]) == "" {
+			message, suggestion := diagnoseProcfileLine(text)
+			problems = append(problems, procfileProblem{line, text, message, suggestion})
+			continue
+		}
+		if first, ok := defined[parts[1]]; ok {
+			problems = append(problems, procfileProblem{Line: line, Text: text, Message: fmt.Sprintf("%s is already defined on line %d", parts[1], first)})
+			continue
 		}
+		defined[parts[1]] = line
+		pf.Entries = append(pf.Entries, ProcfileEntry{parts[1], parts[2]})
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("Reading Procfile: %s", err)
 	}
+	if len(problems) > 0 {
+		return nil, ProcfileError{Path: "Procfile", Problems: problems}
+	}
 	return pf, nil
 }
+
+// diagnoseProcfileLine explains why a line isn't a valid entry.
+func diagnoseProcfileLine(text string) (message, suggestion string) {
+	trimmed := strings.TrimSpace(text)
+	colon := strings.Index(trimmed, ":")
+	fields := strings.Fields(trimmed)
+
+	if colon != -1 && procfileNameRegexp.MatchString(strings.TrimSpace(trimmed[:colon])) {
+		name := strings.TrimSpace(trimmed[:colon])
+		command := strings.TrimSpace(trimmed[colon+1:])
+		if command == "" {
+			return fmt.Sprintf("%s has no command", name), ""
+		}
+		return "The process name must start the line and be followed by the colon right away", name + ": " + command
+	}
+	if procfileNameRegexp.MatchString(fields[0]) && len(fields) > 1 {
+		return "There's no colon after the process name", fields[0] + ": " + strings.TrimSpace(trimmed[len(fields[0]):])
+	}
+	if colon > 0 {
+		name := strings.Map(func(r rune) rune {
+			if r == '_' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return '_'
+		}, strings.TrimSpace(trimmed[:colon]))
+		if command := strings.TrimSpace(trimmed[colon+1:]); command != "" {
+			suggestion = name + ": " + command
+		}
+		return "Process names may only contain letters, digits, _ and -", suggestion
+	}
+	return `Not an entry, which looks like "web: <command>"`, ""
+}
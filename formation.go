@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// parseFormation parses foreman-style process counts such as "web=1 worker=2"
+// or "web=1,worker=2". The special name "all" sets the count for every entry
+// that isn't mentioned explicitly.
+func parseFormation(formation string) (map[string]int, error) {
+	counts := make(map[string]int)
+	fields := strings.FieldsFunc(formation, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid formation entry %q, expected name=count", field)
+		}
+		count, err := strconv.Atoi(parts[1])
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("Invalid process count in formation entry %q", field)
+		}
+		counts[parts[0]] = count
+	}
+	return counts, nil
+}
+
+// formationCount returns how many processes of the given Procfile entry to run.
+func formationCount(counts map[string]int, name string) int {
+	if count, ok := counts[name]; ok {
+		return count
+	}
+	return counts["all"]
+}
+
+// worker is a non-web process of an app's formation, such as "worker.1".
+// Workers run in the process group of the app's web process, so they are
+// stopped together with it. The backend's mtx guards process.
+type worker struct {
+	name    string
+	command string
+	port    int
+	env     []string
+	process *os.Process
+}
+
+// workersFor builds the list of processes to run besides the web process.
+// Like foreman, each Procfile entry gets its own block of 100 ports (counted
+// up from the web process' port), and each instance one port within that
+// block.
+func workersFor(procfile *Procfile, webProcess string, counts map[string]int, webPort int) ([]*worker, error) {
+	var workers []*worker
+	block := 0
+	for _, entry := range procfile.Entries {
+		if entry.Name == webProcess || entry.Name == "release" {
+			continue // release is run as the app's setup command
+		}
+		count := formationCount(counts, entry.Name)
+		if count == 0 {
+			continue
+		}
+		block++
+		for i := 1; i <= count; i++ {
+			port := webPort + block*100 + i - 1
+			if port > 65535 {
+				var err error
+				port, err = getFreeTCPPort()
+				if err != nil {
+					return nil, err
+				}
+			}
+			workers = append(workers, &worker{name: entry.Name + "." + strconv.Itoa(i), command: entry.Command, port: port})
+		}
+	}
+	return workers, nil
+}
+
+// launchWorker starts a worker, whose output is passed on to gowd's log (never
+// to its stdout) through the worker's log file.
+func (b *Backend) launchWorker(w *worker) (*exec.Cmd, *logTail, error) {
+	argv, err := b.launcher.argv(w.command, b.limits.ulimits(b.cgroup != nil), true, w.env)
+	if err != nil {
+		return nil, nil, err
+	}
+	path := logPath(b.name, w.name)
+	logFile, err := createLog(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer logFile.Close()
+	cmd := launch(argv, w.env)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.Dir = b.appPath
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: b.pgid}
+	b.cgroup.apply(cmd.SysProcAttr)
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	tail, err := tailLog(path, b.redact.Writer(os.Stderr), false)
+	if err != nil {
+		log.Println("not following the output of", b.appPath, w.name, "-", err)
+	}
+	return cmd, tail, nil
+}
+
+func (b *Backend) startWorker(w *worker) error {
+	cmd, tail, err := b.launchWorker(w)
+	if err != nil {
+		return err
+	}
+	b.mtx.Lock()
+	w.process = cmd.Process
+	b.mtx.Unlock()
+	log.Println("Started", b.appPath, w.name, "pid", cmd.Process.Pid, "on port", w.port)
+
+	go b.superviseWorker(w, cmd, tail)
+	return nil
+}
+
+// superviseWorker restarts a worker when it exits while the app is still
+// supposed to be running, backing off if it keeps crashing.
+func (b *Backend) superviseWorker(w *worker, cmd *exec.Cmd, tail *logTail) {
+	delay := 1 * time.Second
+	for {
+		startedAt := time.Now()
+		err := cmd.Wait()
+		tail.Close()
+		if b.stopped() {
+			return
+		}
+		if time.Since(startedAt) > 1*time.Minute {
+			delay = 1 * time.Second
+		}
+		log.Println(b.appPath, w.name, "exited:", err, "- restarting in", delay)
+		time.Sleep(delay)
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+		if b.stopped() {
+			return
+		}
+
+		cmd, tail, err = b.launchWorker(w)
+		if err != nil {
+			log.Println("failed to restart", b.appPath, w.name, "-", err)
+			return
+		}
+		b.mtx.Lock()
+		w.process = cmd.Process
+		b.mtx.Unlock()
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maxReplays is how often a request is sent again after its backend turned out
+// to be gone.
+const maxReplays = 3
+
+// RequestHolder is implemented by selectors that can hold a request whose
+// backend went away, e.g. because the app is restarting, until there is a new
+// one to send it to.
+type RequestHolder interface {
+	// Reselect is called when the backend at address refused a connection.
+	// It waits for the app to come back and returns the address to use
+	// instead, like Select, or errNotHeld if the request shouldn't be retried.
+	Reselect(requestHost, address string) (string, func(), error)
+}
+
+var errNotHeld = errors.New("Request is not held")
+
+// unavailableError is shown as a 503, asking the client to try again later.
+type unavailableError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e unavailableError) Error() string {
+	return e.reason
+}
+
+// heldBackend is backend, with the request waiting for a boot or restart in a
+// queue of limited length. Waiting for a restart is limited to timeout, while a
+// cold boot takes as long as it takes: its setup command and the boot itself
+// have timeouts of their own.
+func (p *BackendPool) heldBackend(name string, config AppConfig, timeout time.Duration) (*Backend, error) {
+	p.mtx.Lock()
+	backend := p.backends[name]
+	p.mtx.Unlock()
+	if backend != nil && !backend.IsRestartRequested() {
+		return p.backend(name, nil)
+	}
+	if backend == nil {
+		timeout = 0
+	}
+
+	p.mtx.Lock()
+	if p.held[name] >= config.HoldQueue {
+		p.mtx.Unlock()
+		return nil, unavailableError{"Too many requests are waiting for " + name + " to start", 1 * time.Second}
+	}
+	p.held[name]++
+	p.mtx.Unlock()
+	defer func() {
+		p.mtx.Lock()
+		p.held[name]--
+		p.mtx.Unlock()
+	}()
+
+	type result struct {
+		backend *Backend
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		backend, err := p.backend(name, nil)
+		done <- result{backend, err}
+	}()
+	select {
+	case r := <-done:
+		return r.backend, r.err
+	case <-timeoutChan(timeout):
+		return nil, unavailableError{"Timed out waiting for " + name + " to start", 5 * time.Second}
+	}
+}
+
+func (p *BackendPool) Reselect(host, failed string) (string, func(), error) {
+	name := appForHost(host)
+	config, _ := loadAppConfig(name) // if it's broken, spawning will tell
+	started := time.Now()
+
+	// the backend's exit is noticed shortly after it stops accepting
+	// connections, so give that a moment before spawning a new one
+	for {
+		p.mtx.Lock()
+		backend := p.backends[name]
+		p.mtx.Unlock()
+		if backend != nil && backend.proxy {
+			return "", nil, errNotHeld
+		}
+		if backend == nil || backend.IsRestartRequested() || !backend.serves(failed) {
+			break
+		}
+		if config.HoldTimeout.Duration != 0 && time.Since(started) > config.HoldTimeout.Duration {
+			return "", nil, unavailableError{"Timed out waiting for " + name + " to accept connections", 5 * time.Second}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	timeout := time.Duration(0)
+	if config.HoldTimeout.Duration != 0 {
+		timeout = config.HoldTimeout.Duration - time.Since(started)
+		if timeout <= 0 {
+			timeout = 1
+		}
+	}
+	backend, err := p.heldBackend(name, config, timeout)
+	if err != nil {
+		return "", nil, err
+	}
+	backend.Touch()
+	address, release := backend.Acquire()
+	return address, release, nil
+}
+
+// serves tells whether an instance that is up listens at address.
+func (b *Backend) serves(address string) bool {
+	for _, inst := range b.instances {
+		if b.isUp(inst) && b.instanceAddress(inst) == address {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyHeldRequest is proxyRequest for plain HTTP requests, except that a
+// request whose backend refuses the connection is held and sent again once
+// holder has found a new one.
+func proxyHeldRequest(w http.ResponseWriter, r *http.Request, holder RequestHolder, backend string, release func()) {
+	// the body can only be sent again if it hasn't been read yet
+	var body *replayableBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &replayableBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := forwardRequest(r, backend)
+		if err == nil {
+			defer release()
+			copyResponse(w, resp)
+			return
+		}
+		release()
+
+		if attempt > maxReplays || !replayable(r, err) || (body != nil && atomic.LoadInt32(&body.read) != 0) {
+			writeErrorPage(w, err)
+			return
+		}
+		log.Println("holding request for", r.Host+r.URL.Path, "-", err)
+
+		var holdErr error
+		backend, release, holdErr = holder.Reselect(r.Host, backend)
+		if holdErr == errNotHeld {
+			writeErrorPage(w, err)
+			return
+		}
+		if holdErr != nil {
+			writeErrorPage(w, holdErr)
+			return
+		}
+	}
+}
+
+// replayableBody records whether a request body has been read, and keeps the
+// transport from closing it, which would rule out sending it again.
+type replayableBody struct {
+	io.ReadCloser
+	read int32 // set from the transport's goroutine
+}
+
+func (b *replayableBody) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&b.read, 1)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *replayableBody) Close() error {
+	return nil // the server closes the original body
+}
+
+// replayable tells whether r can safely be sent again after failing with err:
+// either it never reached the backend, or the backend went away without
+// answering a request that doesn't change anything.
+func replayable(r *http.Request, err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	idempotent := r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+	return idempotent && (errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF))
+}
@@ -26,49 +26,89 @@ var hopHeaders = []string{
 }
 
 type BackendSelector interface {
-	Select(requestHost string) (string, error)
+	// Select returns the address of the backend to send the request to. The
+	// returned release func must be called once the request has been handled.
+	Select(requestHost string) (string, func(), error)
 }
 
-func ListenAndServeHTTP(address string, sel BackendSelector) error {
-	proxyHandler := http.HandlerFunc(makeProxyHandlerFunc(sel))
+func ListenAndServeHTTP(address string, sel BackendSelector, control http.Handler) error {
+	proxyHandler := http.HandlerFunc(makeProxyHandlerFunc(sel, control))
 	return http.ListenAndServe(address, proxyHandler)
 }
 
-func makeProxyHandlerFunc(sel BackendSelector) func(http.ResponseWriter, *http.Request) {
+func makeProxyHandlerFunc(sel BackendSelector, control http.Handler) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		backend, err := sel.Select(r.Host)
+		// only gow.dev itself, so that an app linked as ~/.pow/gow can
+		// still be reached through its subdomains
+		if r.Host == controlAppName+".dev" {
+			control.ServeHTTP(w, r)
+			return
+		}
+
+		if booter, ok := sel.(BackgroundBooter); ok {
+			if r.URL.Path == bootEventsPath {
+				serveBootEvents(w, r, booter.Booting(r.Host))
+				return
+			}
+			// browsers get to watch the app boot instead of waiting for it
+			if wantsBootPage(r) && booter.Booting(r.Host) != nil {
+				writeBootPage(w, r)
+				return
+			}
+		}
+
+		backend, release, err := sel.Select(r.Host)
 
-		if err == nil {
-			proxyRequest(w, r, backend)
-		} else {
+		if err != nil {
 			writeErrorPage(w, err)
+			return
 		}
+		if holder, ok := sel.(RequestHolder); ok && !isWebsocketRequest(r) {
+			proxyHeldRequest(w, r, holder, backend, release)
+			return
+		}
+		defer release()
+		proxyRequest(w, r, backend)
 	}
 }
 
-func proxyRequest(w http.ResponseWriter, r *http.Request, backendAddress string) {
-	r.RequestURI = ""
+func isWebsocketRequest(r *http.Request) bool {
+	return r.Header["Connection"] != nil && r.Header["Connection"][0] == "Upgrade" &&
+		r.Header["Upgrade"] != nil && r.Header["Upgrade"][0] == "websocket"
+}
 
-	if r.Header["Connection"] != nil && r.Header["Connection"][0] == "Upgrade" &&
-		r.Header["Upgrade"] != nil && r.Header["Upgrade"][0] == "websocket" {
+func proxyRequest(w http.ResponseWriter, r *http.Request, backendAddress string) {
+	if isWebsocketRequest(r) {
+		r.RequestURI = ""
 		proxyWebsocket(w, r, backendAddress)
 		return
 	}
 
-	r.URL.Scheme = "http"
-	r.URL.Host = backendAddress
-
-	resp, err := http.DefaultTransport.RoundTrip(r)
-
+	resp, err := forwardRequest(r, backendAddress)
 	if err != nil {
 		writeErrorPage(w, err)
 		return
 	}
+	copyResponse(w, resp)
+}
+
+// forwardRequest sends r on to the backend and returns its response.
+func forwardRequest(r *http.Request, backendAddress string) (*http.Response, error) {
+	r.RequestURI = ""
+
+	transport, host := transportFor(backendAddress)
+	r.URL.Scheme = "http"
+	r.URL.Host = host
+
+	return transport.RoundTrip(r)
+}
 
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
 	writeResponseHeader(w, resp)
 
 	// just stream the body to the client
-	_, err = io.Copy(w, resp.Body)
+	_, err := io.Copy(w, resp.Body)
 	if err != nil {
 		log.Println(err)
 	}
@@ -86,9 +126,10 @@ var upgrader = websocket.Upgrader{
 var dialer = websocket.DefaultDialer
 
 func proxyWebsocket(w http.ResponseWriter, req *http.Request, backendAddress string) {
+	dialer, host := websocketDialerFor(backendAddress)
 	backendURL := *req.URL
 	backendURL.Scheme = "ws"
-	backendURL.Host = backendAddress
+	backendURL.Host = host
 
 	// Pass headers from the incoming request to the dialer to forward them to
 	// the final destinations.
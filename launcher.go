@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LauncherConfig controls how an app's commands are run. By default, that's
+// `bash -c "exec <command>"`.
+type LauncherConfig struct {
+	// Shell is "bash", "zsh", "sh", or "none" to run commands directly. They
+	// are then split into words like a shell would, and $VARIABLES are
+	// expanded, but that's it.
+	Shell string `toml:"shell"`
+
+	// Wrapper is put in front of every command, e.g. "nix develop --command".
+	Wrapper string `toml:"wrapper"`
+
+	// Direnv loads the environment from the app's .envrc with direnv.
+	Direnv bool `toml:"direnv"`
+}
+
+var defaultLauncherConfig = LauncherConfig{Shell: "bash"}
+
+func (c LauncherConfig) validate() error {
+	switch c.Shell {
+	case "bash", "zsh", "sh", "none":
+	default:
+		return fmt.Errorf("Unknown shell %q, use bash, zsh, sh or none", c.Shell)
+	}
+	if _, err := splitWords(c.Wrapper, nil); err != nil {
+		return fmt.Errorf("Invalid wrapper: %s", err)
+	}
+	return nil
+}
+
+// argv returns the command line that runs command. prelude is shell code to
+// run before it. With replace, the shell execs the command, so that it gets
+// our signals directly.
+func (c LauncherConfig) argv(command, prelude string, replace bool, env []string) ([]string, error) {
+	argv, err := splitWords(c.Wrapper, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Shell == "none" {
+		if prelude != "" {
+			return nil, errors.New("This needs a shell, but the launcher is configured without one")
+		}
+		words, err := splitWords(command, env)
+		if err != nil {
+			return nil, err
+		}
+		if len(words) == 0 {
+			return nil, errors.New("Empty command")
+		}
+		return append(argv, words...), nil
+	}
+	if replace {
+		command = "exec " + command
+	}
+	shell := c.Shell
+	if shell == "" {
+		shell = "bash"
+	}
+	return append(argv, shell, "-c", prelude+command), nil
+}
+
+// launch builds the command for argv with the given environment. Unlike with
+// exec.Command, the program is looked up in the PATH of that environment, since
+// the app's toolchain or wrapper might not be in gowd's.
+func launch(argv []string, env []string) *exec.Cmd {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = env
+	if strings.Contains(argv[0], "/") {
+		return cmd
+	}
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "PATH=") {
+			continue
+		}
+		for _, dir := range filepath.SplitList(strings.TrimPrefix(kv, "PATH=")) {
+			path := filepath.Join(dir, argv[0])
+			if fi, err := os.Stat(path); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+				cmd.Path = path
+				cmd.Err = nil
+				break
+			}
+		}
+	}
+	return cmd
+}
+
+// splitWords splits a command line into words the way a shell would, with
+// quotes and backslashes, expanding $NAME and ${NAME} from env unless it's
+// nil. Anything fancier needs a real shell.
+func splitWords(s string, env []string) ([]string, error) {
+	lookup := make(map[string]string)
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 {
+			lookup[kv[:i]] = kv[i+1:]
+		}
+	}
+	expand := func(i int) (string, int) {
+		if env == nil || i+1 >= len(s) {
+			return "$", i + 1
+		}
+		if s[i+1] == '{' {
+			end := strings.Index(s[i:], "}")
+			if end == -1 {
+				return "$", i + 1
+			}
+			return lookup[s[i+2:i+end]], i + end + 1
+		}
+		j := i + 1
+		for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || j > i+1 && s[j] >= '0' && s[j] <= '9') {
+			j++
+		}
+		if j == i+1 {
+			return "$", i + 1
+		}
+		return lookup[s[i+1:j]], j
+	}
+
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); {
+		switch ch := s[i]; {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			i++
+		case ch == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end == -1 {
+				return nil, errors.New("Unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			inWord = true
+			i += end + 2
+		case ch == '"':
+			inWord = true
+			i++
+			for {
+				if i >= len(s) {
+					return nil, errors.New("Unterminated double quote")
+				}
+				if s[i] == '"' {
+					i++
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\", s[i+1]) != -1 {
+					word.WriteByte(s[i+1])
+					i += 2
+					continue
+				}
+				if s[i] == '$' {
+					value, next := expand(i)
+					word.WriteString(value)
+					i = next
+					continue
+				}
+				word.WriteByte(s[i])
+				i++
+			}
+		case ch == '\\':
+			if i+1 < len(s) {
+				word.WriteByte(s[i+1])
+			}
+			inWord = true
+			i += 2
+		case ch == '$':
+			value, next := expand(i)
+			word.WriteString(value)
+			inWord = true
+			i = next
+		default:
+			word.WriteByte(ch)
+			inWord = true
+			i++
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// loadDirenv applies what `direnv export json` makes of the app's .envrc. It
+// has to have been allowed with `direnv allow` first.
+func (e *appEnv) loadDirenv(pathToApp string) error {
+	var stdout, stderr bytes.Buffer
+	cmd := launch([]string{"direnv", "export", "json"}, e.List())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Dir = pathToApp
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintln(&stderr, err)
+		return BootCrash{Log: stderr.Bytes(), Env: e.List(), Cmd: "direnv export json", Path: pathToApp}
+	}
+	if stdout.Len() == 0 {
+		return nil // nothing to change
+	}
+
+	var changes map[string]*string
+	if err := json.Unmarshal(stdout.Bytes(), &changes); err != nil {
+		return fmt.Errorf("Reading the output of direnv export json: %s", err)
+	}
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasPrefix(name, "DIRENV_") {
+			continue // direnv's own bookkeeping
+		}
+		if changes[name] == nil {
+			e.unset(name)
+		} else {
+			e.set(name, *changes[name], ".envrc")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LimitsConfig caps the resources an app can take up, so that a runaway app
+// can't take the whole machine down with it. Memory and CPU are enforced by a
+// cgroup v2 subtree per app where available. Otherwise memory is limited per
+// process with an rlimit, and CPU not at all.
+type LimitsConfig struct {
+	// Memory is how much memory the app may use, e.g. "512M" or "2G".
+	Memory string `toml:"memory"`
+
+	// CPU is how many CPUs' worth of time the app may use, e.g. 1.5.
+	CPU float64 `toml:"cpu"`
+
+	// OpenFiles is how many files each process may have open.
+	OpenFiles int `toml:"open_files"`
+}
+
+func (c LimitsConfig) validate() error {
+	if c.Memory != "" {
+		if _, err := parseSize(c.Memory); err != nil {
+			return err
+		}
+	}
+	if c.CPU < 0 {
+		return fmt.Errorf("Invalid CPU limit %v", c.CPU)
+	}
+	if c.OpenFiles < 0 {
+		return fmt.Errorf("Invalid open files limit %d", c.OpenFiles)
+	}
+	return nil
+}
+
+// needCgroup tells whether any of the limits is best enforced by a cgroup.
+func (c LimitsConfig) needCgroup() bool {
+	return c.Memory != "" || c.CPU != 0
+}
+
+// ulimits returns the bash commands that apply the limits which are enforced
+// through rlimits. Memory only is if there is no cgroup to take care of it.
+func (c LimitsConfig) ulimits(cgroup bool) string {
+	script := ""
+	if c.OpenFiles != 0 {
+		script += "ulimit -n " + strconv.Itoa(c.OpenFiles) + "; "
+	}
+	if c.Memory != "" && !cgroup {
+		size, _ := parseSize(c.Memory)
+		script += "ulimit -d " + strconv.FormatInt(size/1024, 10) + "; "
+	}
+	return script
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix, in
+// powers of 1024.
+func parseSize(s string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(number, suffix) {
+			number = strings.TrimSuffix(number, suffix)
+			unit = int64(1) << (10 * uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid size %q, expected e.g. 512M or 2G", s)
+	}
+	return n * unit, nil
+}
+
+// exceededLimit names the limit that made the app's processes get killed
+// since it was last asked, if any, e.g. "memory limit of 1G".
+func (b *Backend) exceededLimit() string {
+	kills := b.cgroup.oomKills()
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if kills <= b.oomKills {
+		return ""
+	}
+	b.oomKills = kills
+	return "memory limit of " + b.limits.Memory
+}
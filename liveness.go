@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// LivenessConfig enables periodic probes of an app's web processes after they
+// have booted. A process that deadlocked is still alive as far as the OS is
+// concerned, so this is the only way to notice it.
+type LivenessConfig struct {
+	// Check is "http" (a GET of Path returns Status within Timeout), "tcp"
+	// (something accepts connections) or empty to disable probing.
+	Check    string   `toml:"check"`
+	Path     string   `toml:"path"`
+	Status   int      `toml:"status"`
+	Timeout  Duration `toml:"timeout"`
+	Interval Duration `toml:"interval"`
+	// Failures is the number of failed probes in a row after which the app
+	// is restarted.
+	Failures int `toml:"failures"`
+}
+
+var defaultLivenessConfig = LivenessConfig{
+	Path:     "/",
+	Status:   200,
+	Timeout:  Duration{2 * time.Second},
+	Interval: Duration{10 * time.Second},
+	Failures: 3,
+}
+
+func (c LivenessConfig) validate() error {
+	switch c.Check {
+	case "", "tcp", "http":
+	default:
+		return fmt.Errorf("Unknown liveness check %q, use tcp or http", c.Check)
+	}
+	if c.Check != "" && (c.Interval.Duration <= 0 || c.Failures < 1) {
+		return fmt.Errorf("The liveness check needs an interval and at least one allowed failure")
+	}
+	return nil
+}
+
+func (c LivenessConfig) check(address string) readinessCheck {
+	if c.Check == "http" {
+		return httpCheck(address, c.Path, c.Status, c.Timeout.Duration)
+	}
+	return connectCheck(address)
+}
+
+// watchLiveness probes the backend's web processes until it goes away. Once
+// one of them fails too many probes in a row, it is considered hung and the
+// backend is restarted.
+func (b *Backend) watchLiveness(c LivenessConfig) {
+	failures := make(map[*instance]int)
+	for {
+		time.Sleep(c.Interval.Duration)
+		if b.stopped() {
+			return
+		}
+
+		for _, inst := range b.instances {
+			if !b.isUp(inst) {
+				continue
+			}
+			if c.check(b.instanceAddress(inst))() {
+				failures[inst] = 0
+				continue
+			}
+
+			failures[inst]++
+			log.Println(b.appPath, inst.name, "failed liveness check", failures[inst], "of", c.Failures)
+			if failures[inst] >= c.Failures {
+				b.restart(fmt.Sprintf("%s failed %d %s liveness checks in a row", inst.name, failures[inst], c.Check))
+				return
+			}
+		}
+	}
+}
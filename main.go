@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -8,6 +9,14 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "secrets" {
+		if err := runSecrets(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "gow:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	errors := make(chan error)
 
 	go func() {
@@ -17,7 +26,19 @@ func main() {
 		}
 	}()
 
+	config, err := LoadConfig()
+	if err != nil {
+		log.Println("config error:", err)
+		config = &Config{}
+	}
+
 	pool := NewBackendPool()
+	go func() {
+		pool.Restore()
+		if len(config.Prewarm) > 0 {
+			pool.Prewarm(config.Prewarm, config.PrewarmParallelism)
+		}
+	}()
 
 	termchan := make(chan os.Signal, 2)
 	signal.Notify(termchan, os.Interrupt, syscall.SIGTERM)
@@ -31,5 +52,5 @@ func main() {
 	}()
 
 	log.Println("Ready!")
-	log.Fatalln(ListenAndServeHTTP("127.0.0.1:20559", pool))
+	log.Fatalln(ListenAndServeHTTP("127.0.0.1:20559", pool, NewControlHandler(pool)))
 }
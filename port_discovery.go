@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Some apps hardcode their port and never look at $PORT. If port_discovery is
+// on, rather than waiting for them to time out, we look at what their process
+// tree actually listens on (where the OS lets us), and route to that.
+
+// discoveryGracePeriod is how long we give an app to bind $PORT before looking
+// elsewhere. Plenty of apps open some other port (for a debugger, say) first.
+const discoveryGracePeriod = 2 * time.Second
+
+// withPortDiscovery wraps the readiness check of a web process that should be
+// listening on inst.port, switching the instance to the port it really uses.
+// If the app listens on more than one port, there's no telling which one is
+// for requests, so it keeps waiting for $PORT.
+func (b *Backend) withPortDiscovery(inst *instance, check readinessCheck) readinessCheck {
+	started := time.Now()
+	warned := false
+	return func() bool {
+		if check() {
+			return true
+		}
+		pid := b.pid(inst)
+		if time.Since(started) < discoveryGracePeriod || pid == 0 {
+			return false
+		}
+
+		ports, err := listeningPorts(pid)
+		if err != nil || len(ports) == 0 {
+			return false
+		}
+		b.mtx.Lock()
+		current := inst.port
+		b.mtx.Unlock()
+		for _, port := range ports {
+			if port == current {
+				// it's there, just not ready yet
+				return false
+			}
+		}
+		if len(ports) > 1 {
+			if !warned {
+				log.Println("warning:", b.appPath, inst.name, "ignores $PORT", current, "and listens on several ports", ports, "- not picking one")
+				warned = true
+			}
+			return false
+		}
+
+		log.Println("warning:", b.appPath, inst.name, "ignores $PORT", current, "and listens on port", ports[0], "instead")
+		b.mtx.Lock()
+		inst.port = ports[0]
+		b.mtx.Unlock()
+		check = b.readiness.check(b.instanceAddress(inst), inst.output)
+		return check()
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// procStat is what we need to know from /proc/<pid>/stat.
+type procStat struct {
+	ppid    int
+	pgrp    int
+	cpu     time.Duration // user and system time
+	threads int
+	rss     int64 // bytes
+}
+
+// clockTicks is the unit of the CPU times in /proc/<pid>/stat, which is the
+// same on all Linux architectures we care about.
+const clockTicks = 100
+
+// readProcStats reads the stats of all running processes.
+func readProcStats() map[int]procStat {
+	stats := make(map[int]procStat)
+	entries, _ := ioutil.ReadDir("/proc")
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// the command name is in parens and may contain anything, so look
+		// for the fields after the last one: "pid (comm) state ppid pgrp ..."
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+		var s procStat
+		s.ppid, _ = strconv.Atoi(fields[1])
+		s.pgrp, _ = strconv.Atoi(fields[2])
+		utime, _ := strconv.ParseInt(fields[11], 10, 64)
+		stime, _ := strconv.ParseInt(fields[12], 10, 64)
+		s.cpu = time.Duration(utime+stime) * time.Second / clockTicks
+		s.threads, _ = strconv.Atoi(fields[17])
+		rss, _ := strconv.ParseInt(fields[21], 10, 64)
+		s.rss = rss * int64(os.Getpagesize())
+		stats[pid] = s
+	}
+	return stats
+}
+
+// descendants returns the given pids and the pids of all their descendants.
+func descendants(stats map[int]procStat, pids []int) []int {
+	children := make(map[int][]int)
+	for pid, s := range stats {
+		children[s.ppid] = append(children[s.ppid], pid)
+	}
+
+	seen := make(map[int]bool)
+	var tree []int
+	for _, pid := range pids {
+		if !seen[pid] {
+			seen[pid] = true
+			tree = append(tree, pid)
+		}
+	}
+	for i := 0; i < len(tree); i++ {
+		for _, child := range children[tree[i]] {
+			if !seen[child] {
+				seen[child] = true
+				tree = append(tree, child)
+			}
+		}
+	}
+	return tree
+}
+
+// processTree returns pid and the pids of all its descendants.
+func processTree(pid int) []int {
+	return descendants(readProcStats(), []int{pid})
+}
+
+// processGroupUsage adds up the resources used by the members of process group
+// pgid and everything they spawned, even if it left the group.
+func processGroupUsage(pgid int) (resourceUsage, bool) {
+	stats := readProcStats()
+	var members []int
+	for pid, s := range stats {
+		if s.pgrp == pgid {
+			members = append(members, pid)
+		}
+	}
+	if len(members) == 0 {
+		return resourceUsage{}, false
+	}
+
+	usage := resourceUsage{At: time.Now()}
+	for _, pid := range descendants(stats, members) {
+		s := stats[pid]
+		usage.Processes++
+		usage.RSS += s.rss
+		usage.CPUSeconds += s.cpu.Seconds()
+		usage.Threads += s.threads
+		fds, _ := ioutil.ReadDir("/proc/" + strconv.Itoa(pid) + "/fd")
+		usage.FDs += len(fds)
+	}
+	return usage, true
+}
+
+// socketInodes adds the inodes of all sockets pid has open to inodes.
+func socketInodes(pid int, inodes map[string]bool) {
+	dir := "/proc/" + strconv.Itoa(pid) + "/fd"
+	fds, _ := ioutil.ReadDir(dir)
+	for _, fd := range fds {
+		link, err := os.Readlink(dir + "/" + fd.Name())
+		if err == nil && strings.HasPrefix(link, "socket:[") {
+			inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+		}
+	}
+}
+
+// listeningPorts returns the TCP ports that pid or any of its descendants
+// listen on, in ascending order.
+func listeningPorts(pid int) ([]int, error) {
+	inodes := make(map[string]bool)
+	for _, p := range processTree(pid) {
+		socketInodes(p, inodes)
+	}
+
+	seen := make(map[int]bool)
+	var ports []int
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		fd, err := os.Open(table)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(fd)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || fields[3] != "0A" || !inodes[fields[9]] {
+				continue // not a listening socket of ours
+			}
+			local := fields[1]
+			port, err := strconv.ParseInt(local[strings.LastIndex(local, ":")+1:], 16, 32)
+			if err == nil && !seen[int(port)] {
+				seen[int(port)] = true
+				ports = append(ports, int(port))
+			}
+		}
+		fd.Close()
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
+
+// processEnviron returns the environment pid was started with.
+func processEnviron(pid int) []string {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/environ")
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+// There's no /proc to look at, so we can't tell.
+func listeningPorts(pid int) ([]int, error) {
+	return nil, nil
+}
+
+// There's no /proc to read it from.
+func processEnviron(pid int) []string {
+	return nil
+}
+
+// Without /proc, there's no cheap way to find out.
+func processGroupUsage(pgid int) (resourceUsage, bool) {
+	return resourceUsage{}, false
+}
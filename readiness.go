@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// ReadinessConfig determines when a freshly spawned web process counts as up.
+// Many servers bind their port well before they can actually serve requests,
+// so accepting a TCP connection isn't always good enough.
+type ReadinessConfig struct {
+	// Check is one of "tcp" (something accepts connections on $PORT, or on
+	// $SOCKET for Unix socket backends),
+	// "http" (a GET of Path returns Status) or "log" (the process printed
+	// something matching Pattern).
+	Check   string `toml:"check"`
+	Path    string `toml:"path"`
+	Status  int    `toml:"status"`
+	Pattern string `toml:"pattern"`
+}
+
+var defaultReadinessConfig = ReadinessConfig{
+	Check:  "tcp",
+	Path:   "/",
+	Status: 200,
+}
+
+// readinessCheck reports whether a process is ready. It is called repeatedly
+// until it returns true.
+type readinessCheck func() bool
+
+func (c ReadinessConfig) validate() error {
+	switch c.Check {
+	case "tcp", "http":
+		return nil
+	case "log":
+		if c.Pattern == "" {
+			return fmt.Errorf("The log readiness check needs a pattern")
+		}
+		if _, err := regexp.Compile(c.Pattern); err != nil {
+			return fmt.Errorf("Invalid readiness pattern %q: %s", c.Pattern, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown readiness check %q, use tcp, http or log", c.Check)
+}
+
+// check builds the check for the web process listening on address, whose
+// output goes to output. The configuration must have been validated.
+func (c ReadinessConfig) check(address string, output *bootLog) readinessCheck {
+	switch c.Check {
+	case "http":
+		return httpCheck(address, c.Path, c.Status, 2*time.Second)
+	case "log":
+		return logCheck(output, regexp.MustCompile(c.Pattern))
+	}
+	return connectCheck(address)
+}
+
+// connectCheck succeeds once something accepts connections on address, be it
+// a TCP port or a Unix socket.
+func connectCheck(address string) readinessCheck {
+	return func() bool {
+		conn, err := dialBackend(address, 1*time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+}
+
+func httpCheck(address, path string, status int, timeout time.Duration) readinessCheck {
+	transport, host := transportFor(address)
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		// a redirect to a login page is as ready as it gets
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return func() bool {
+		resp, err := client.Get("http://" + host + path)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == status
+	}
+}
+
+func logCheck(output *bootLog, pattern *regexp.Regexp) readinessCheck {
+	return func() bool {
+		return pattern.Match(output.Bytes())
+	}
+}
+
+// await runs check until it succeeds, in which case the returned channel is
+// closed, or until stop is closed.
+func await(check readinessCheck, stop <-chan struct{}) <-chan struct{} {
+	ready := make(chan struct{})
+	go func() {
+		for {
+			if check() {
+				close(ready)
+				return
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	}()
+	return ready
+}
+
+// timeoutChan returns a channel that fires after d, or never if d is zero.
+func timeoutChan(d time.Duration) <-chan time.Time {
+	if d == 0 {
+		return nil
+	}
+	return time.After(d)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// defaultRedactPatterns match the names of variables whose values are kept
+// off crash pages and out of logs.
+var defaultRedactPatterns = []string{"*_KEY", "*_SECRET", "*PASSWORD*", "*_TOKEN"}
+
+// redactedValue is shown in place of a secret.
+const redactedValue = "[REDACTED]"
+
+// minSecretLength keeps values like "1" or "true" from being scrubbed from
+// every line of output.
+const minSecretLength = 4
+
+func validateRedactPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid redact pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func isSecret(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// redactor scrubs the values of an environment's secrets from output. A nil
+// redactor leaves everything as it is.
+type redactor struct {
+	secrets [][]byte
+}
+
+func newRedactor(env []string, patterns []string) *redactor {
+	r := new(redactor)
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		if i <= 0 || len(kv)-i-1 < minSecretLength || !isSecret(kv[:i], patterns) {
+			continue
+		}
+		r.secrets = append(r.secrets, []byte(kv[i+1:]))
+	}
+	// longest first, in case one secret contains another
+	sort.Slice(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+	return r
+}
+
+func (r *redactor) redact(p []byte) []byte {
+	if r == nil {
+		return p
+	}
+	for _, secret := range r.secrets {
+		if bytes.Contains(p, secret) {
+			p = bytes.Replace(p, secret, []byte(redactedValue), -1)
+		}
+	}
+	return p
+}
+
+// Writer returns a writer that redacts everything before passing it on to w.
+// Secrets are only caught within a single write, which for process output
+// usually means a single line.
+func (r *redactor) Writer(w io.Writer) io.Writer {
+	if r == nil {
+		return w
+	}
+	return redactingWriter{r, w}
+}
+
+type redactingWriter struct {
+	r *redactor
+	w io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(w.r.redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactEnv replaces the values of secrets in env.
+func redactEnv(env []string, patterns []string) []string {
+	redacted := make([]string, len(env))
+	for j, kv := range env {
+		redacted[j] = kv
+		if i := strings.Index(kv, "="); i > 0 && isSecret(kv[:i], patterns) {
+			redacted[j] = kv[:i+1] + redactedValue
+		}
+	}
+	return redacted
+}
+
+// redacted returns the crash with secrets taken out of its log and
+// environment, so that it can be shown to whoever loads the page. Of the
+// environment, only what differs from gowd's own is left.
+func (c BootCrash) redacted(patterns []string) BootCrash {
+	c.Log = newRedactor(c.Env, patterns).redact(c.Log)
+	c.Env = redactEnv(changedEnv(c.Env), patterns)
+	return c
+}
+
+// changedEnv returns the variables of env that gowd's own environment doesn't
+// have, or has with a different value.
+func changedEnv(env []string) []string {
+	base := make(map[string]bool)
+	for _, kv := range os.Environ() {
+		base[kv] = true
+	}
+	var changed []string
+	for _, kv := range env {
+		if !base[kv] {
+			changed = append(changed, kv)
+		}
+	}
+	return changed
+}
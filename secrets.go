@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// encryptedEnvFile holds an app's secrets. It's an env file sealed with NaCl
+// secretbox under the key in ~/.pow/.key: base64 of a random nonce followed by
+// the box.
+const encryptedEnvFile = ".env.enc"
+
+func keyPath() string {
+	return os.Getenv("HOME") + "/.pow/.key"
+}
+
+// loadKey reads the secrets key, which is stored hex-encoded.
+func loadKey() (*[32]byte, error) {
+	data, err := ioutil.ReadFile(keyPath())
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("%s does not hold a key of 32 hex-encoded bytes", keyPath())
+	}
+	var key [32]byte
+	copy(key[:], raw)
+	return &key, nil
+}
+
+// loadOrCreateKey reads the secrets key, generating one if there is none yet.
+func loadOrCreateKey() (*[32]byte, error) {
+	key, err := loadKey()
+	if !os.IsNotExist(err) {
+		return key, err
+	}
+	key = new([32]byte)
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyPath(), []byte(hex.EncodeToString(key[:])+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(os.Stderr, "Created a new key in", keyPath(), "- back it up, or your secrets are lost with it")
+	return key, nil
+}
+
+func encryptSecrets(plaintext []byte, key *[32]byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	box := secretbox.Seal(nonce[:], plaintext, &nonce, key)
+	return []byte(base64.StdEncoding.EncodeToString(box) + "\n"), nil
+}
+
+func decryptSecrets(data []byte, key *[32]byte) ([]byte, error) {
+	box, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(box) < 24 {
+		return nil, errors.New("not an encrypted env file")
+	}
+	var nonce [24]byte
+	copy(nonce[:], box[:24])
+	plaintext, ok := secretbox.Open(nil, box[24:], &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("can't be decrypted with the key in %s", keyPath())
+	}
+	return plaintext, nil
+}
+
+// readEncryptedEnvFile decrypts an app's secrets. A missing file is fine, and
+// returns nil.
+func readEncryptedEnvFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	key, err := loadKey()
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is encrypted, but there is no key in %s", encryptedEnvFile, keyPath())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decryptSecrets(data, key)
+}
+
+// runSecrets implements `gow secrets edit <app>`: the app's secrets are
+// decrypted to a private temporary file, opened in $EDITOR, and encrypted
+// again.
+func runSecrets(args []string) error {
+	if len(args) != 2 || args[0] != "edit" {
+		return errors.New("usage: gow secrets edit <app>")
+	}
+	pathToApp, err := appDir(args[1])
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(pathToApp, encryptedEnvFile)
+
+	key, err := loadOrCreateKey()
+	if err != nil {
+		return err
+	}
+	plaintext := []byte{}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if plaintext, err = decryptSecrets(data, key); err != nil {
+			return fmt.Errorf("%s %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "gow-secrets")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, args[1]+".env")
+	if err := ioutil.WriteFile(tmp, plaintext, 0600); err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	// $EDITOR may come with arguments, like "code --wait"
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", tmp)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %s", editor, err)
+	}
+
+	edited, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, plaintext) {
+		fmt.Fprintln(os.Stderr, "No changes.")
+		return nil
+	}
+	if _, err := godotenv.UnmarshalBytes(edited); err != nil {
+		return fmt.Errorf("Not saving, the secrets aren't a valid env file: %s", err)
+	}
+	sealed, err := encryptSecrets(edited, key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", sealed, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// SetupConfig describes a command that gets an app ready to boot, such as
+// `bundle install`. It runs before the app's processes are started, but only
+// if it or one of the watched files changed since it last succeeded.
+type SetupConfig struct {
+	// Command defaults to the Procfile's release entry.
+	Command string   `toml:"command"`
+	Watch   []string `toml:"watch"`
+	Timeout Duration `toml:"timeout"`
+}
+
+var defaultSetupConfig = SetupConfig{
+	Watch:   []string{"Gemfile.lock", "package-lock.json", "yarn.lock", "go.sum"},
+	Timeout: Duration{10 * time.Minute},
+}
+
+// setupStampPath is where the fingerprint of the app's last successful setup
+// is kept.
+func setupStampPath(appName string) string {
+	return os.Getenv("HOME") + "/.pow/.setup/" + appName
+}
+
+// fingerprint identifies the command and the contents of the watched files.
+func (c SetupConfig) fingerprint(appPath, command string) string {
+	h := sha256.New()
+	io.WriteString(h, command+"\x00")
+	for _, name := range c.Watch {
+		data, err := ioutil.ReadFile(filepath.Join(appPath, name))
+		if err != nil {
+			fmt.Fprintf(h, "%s\x00-\x00", name)
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// runSetup runs the app's setup command if anything changed since it last
+// succeeded, writing a transcript to output.
+func runSetup(appName, appPath, command string, c SetupConfig, launcher LauncherConfig, env []string, output io.Writer) error {
+	fingerprint := c.fingerprint(appPath, command)
+	if stamp, err := ioutil.ReadFile(setupStampPath(appName)); err == nil && string(stamp) == fingerprint {
+		return nil
+	}
+
+	log.Println("Running setup for", appPath+":", command)
+	fmt.Fprintf(output, "$ %s\n", command)
+	argv, err := launcher.argv(command, "", false, env)
+	if err != nil {
+		return err
+	}
+	cmd := launch(argv, env)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Dir = appPath
+	// in a group of its own, so that a timeout takes down whatever it spawned
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("Setup failed: %s", err)
+		}
+	case <-timeoutChan(c.Timeout.Duration):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("Setup didn't finish within %s", c.Timeout)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(setupStampPath(appName)), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(setupStampPath(appName), []byte(fingerprint), 0600)
+}
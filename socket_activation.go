@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// Socket activation hands a web process a socket that gowd bound beforehand,
+// following systemd's LISTEN_FDS protocol: the socket is passed as fd 3, and
+// LISTEN_PID names the process it is meant for. This gets rid of the race in
+// getFreeTCPPort, and lets connections queue up in the socket's backlog while
+// the app boots or is respawned. $PORT is still set to the socket's port.
+//
+// Only enable this for apps that support it. Everything else will try to bind
+// $PORT, which fails since gowd holds it.
+
+// activationSocket is a listening socket passed to a web process.
+type activationSocket struct {
+	listener *net.TCPListener
+	file     *os.File
+}
+
+func bindActivationSocket() (*activationSocket, error) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	f, err := l.File()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &activationSocket{listener: l, file: f}, nil
+}
+
+func (s *activationSocket) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *activationSocket) Close() {
+	s.file.Close()
+	s.listener.Close()
+}
+
+// activationEnv returns env with the LISTEN_* variables for a single socket.
+// LISTEN_PID is filled in by the shell that execs the app, since we only learn
+// its pid after starting it.
+func activationEnv(env []string) []string {
+	env = envWith(env, "LISTEN_FDS", "1")
+	return envWith(env, "LISTEN_FDNAMES", "web")
+}
+
+// activationGracePeriod is how long a socket-activated process has to stay
+// alive to count as booted.
+const activationGracePeriod = 1 * time.Second
+
+// survivesGracePeriod is the tcp readiness check for socket-activated
+// processes. The socket accepts connections before the process even runs, and
+// they are served as soon as it gets around to it, so that tells us nothing.
+// But a process that crashes right away should still get a crash page rather
+// than a bunch of failed requests.
+func survivesGracePeriod() readinessCheck {
+	started := time.Now()
+	return func() bool {
+		return time.Since(started) >= activationGracePeriod
+	}
+}
+
+func closeSockets(instances []*instance) {
+	for _, inst := range instances {
+		if inst != nil && inst.socket != nil {
+			inst.socket.Close()
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// backendState is what we remember about a running app, so that a restarted
+// gowd can find it again: the process group and a member of it, the addresses
+// of its web processes, and the cgroup it runs in, if any. A zero Pid means
+// that the app was shut down together with gowd and should simply be spawned
+// again.
+type backendState struct {
+	App       string    `json:"app"`
+	Pid       int       `json:"pid"`
+	Pgid      int       `json:"pgid"`
+	Addresses []string  `json:"addresses"`
+	StartedAt time.Time `json:"started_at"`
+	Cgroup    string    `json:"cgroup,omitempty"`
+}
+
+func stateFilePath() string {
+	return os.Getenv("HOME") + "/.pow/.state.json"
+}
+
+func readState() ([]backendState, error) {
+	data, err := ioutil.ReadFile(stateFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var states []backendState
+	err = json.Unmarshal(data, &states)
+	return states, err
+}
+
+func writeState(states []backendState) error {
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write and rename, so that a crash never leaves a truncated file behind
+	tmp := stateFilePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFilePath())
+}
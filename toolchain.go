@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// toolVersion is a version of some tool that an app asks for in one of its
+// version files.
+type toolVersion struct {
+	tool    string // as asdf calls it
+	version string
+	file    string
+}
+
+// versionFiles maps the single-tool version files to the tool they are about.
+var versionFiles = []struct {
+	file, tool string
+}{
+	{".ruby-version", "ruby"},
+	{".nvmrc", "nodejs"},
+	{".node-version", "nodejs"},
+	{".go-version", "golang"},
+}
+
+// readToolVersions finds the versions the app asks for. .tool-versions wins
+// over the other files, since it is the one meant to cover everything.
+func readToolVersions(pathToApp string) ([]toolVersion, error) {
+	var versions []toolVersion
+	seen := make(map[string]bool)
+
+	fd, err := os.Open(filepath.Join(pathToApp, ".tool-versions"))
+	if err == nil {
+		scanner := bufio.NewScanner(fd)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i != -1 {
+				line = line[:i]
+			}
+			// "ruby 3.2.2" or, with fallbacks, "ruby 3.2.2 3.1.4"; we only
+			// look at the first
+			fields := strings.Fields(line)
+			if len(fields) < 2 || seen[fields[0]] {
+				continue
+			}
+			seen[fields[0]] = true
+			versions = append(versions, toolVersion{fields[0], fields[1], ".tool-versions"})
+		}
+		fd.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, f := range versionFiles {
+		if seen[f.tool] {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(pathToApp, f.file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		version := strings.TrimSpace(string(data))
+		if version == "" {
+			continue
+		}
+		seen[f.tool] = true
+		versions = append(versions, toolVersion{f.tool, version, f.file})
+	}
+	return versions, nil
+}
+
+// envDir returns $name, or dir within $HOME if it isn't set.
+func envDir(name, dir string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return filepath.Join(os.Getenv("HOME"), dir)
+}
+
+// installDirs lists where asdf, rbenv, nodenv, nvm and goenv keep the versions
+// of a tool they installed. Each is a directory with one entry per version,
+// and the path of the bin directory within such an entry.
+func installDirs(tool string) [][2]string {
+	asdf := [2]string{envDir("ASDF_DATA_DIR", ".asdf") + "/installs/" + tool, asdfBin(tool)}
+	switch tool {
+	case "ruby":
+		return [][2]string{{envDir("RBENV_ROOT", ".rbenv") + "/versions", "bin"}, asdf}
+	case "nodejs":
+		return [][2]string{{envDir("NODENV_ROOT", ".nodenv") + "/versions", "bin"}, {envDir("NVM_DIR", ".nvm") + "/versions/node", "bin"}, asdf}
+	case "golang":
+		return [][2]string{{envDir("GOENV_ROOT", ".goenv") + "/versions", "bin"}, asdf}
+	}
+	return [][2]string{asdf}
+}
+
+func asdfBin(tool string) string {
+	if tool == "golang" {
+		return "go/bin"
+	}
+	return "bin"
+}
+
+// resolveNvmAlias follows nvm aliases such as "default", "lts/*" or
+// "lts/hydrogen", which may point at each other, down to a version. "node"
+// and "stable" stand for the newest version, for which it returns "".
+func resolveNvmAlias(version string) string {
+	for i := 0; i < 10; i++ {
+		if version == "node" || version == "stable" {
+			return ""
+		}
+		alias, err := ioutil.ReadFile(filepath.Join(envDir("NVM_DIR", ".nvm"), "alias", version))
+		if err != nil {
+			break
+		}
+		version = strings.TrimSpace(string(alias))
+	}
+	return version
+}
+
+// binDir finds the bin directory of an installed version of the tool.
+// Versions may be given partially, like "18" in an .nvmrc, which picks the
+// newest matching install. It returns "" if the app wants the system's
+// version, or if there is no version manager for the tool, so that PATH is
+// left alone.
+func (v toolVersion) binDir() (string, error) {
+	version := v.version
+	if v.tool == "nodejs" {
+		version = resolveNvmAlias(version)
+	}
+	switch {
+	case version == "system":
+		return "", nil
+	case strings.HasPrefix(version, "path:"):
+		// asdf's way of using a version that lives somewhere else
+		return filepath.Join(strings.TrimPrefix(version, "path:"), asdfBin(v.tool)), nil
+	case strings.HasPrefix(version, "ref:"):
+		// asdf installs versions built from a git ref as ref-<ref>
+		version = "ref-" + strings.TrimPrefix(version, "ref:")
+	}
+	want := strings.TrimPrefix(strings.TrimPrefix(version, "ruby-"), "v")
+
+	var looked []string
+	managed := false
+	for _, dir := range installDirs(v.tool) {
+		looked = append(looked, dir[0])
+		entries, err := ioutil.ReadDir(dir[0])
+		if err != nil {
+			continue
+		}
+		managed = true
+		var matches []string
+		for _, entry := range entries {
+			installed := strings.TrimPrefix(entry.Name(), "v")
+			if want == "" || installed == want || strings.HasPrefix(installed, want+".") {
+				matches = append(matches, entry.Name())
+			}
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		sort.Slice(matches, func(i, j int) bool {
+			return versionLess(matches[i], matches[j])
+		})
+		return filepath.Join(dir[0], matches[len(matches)-1], dir[1]), nil
+	}
+	if !managed {
+		log.Println(v.file, "asks for", v.tool, v.version, "but no version manager is set up for it, leaving PATH alone")
+		return "", nil
+	}
+	return "", fmt.Errorf("%s %s is required by %s, but isn't installed (looked in %s)", v.tool, v.version, v.file, strings.Join(looked, ", "))
+}
+
+// versionLess compares dotted version numbers numerically where possible.
+func versionLess(a, b string) bool {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		if aerr != nil || berr != nil {
+			if as[i] != bs[i] {
+				return as[i] < bs[i]
+			}
+			continue
+		}
+		if an != bn {
+			return an < bn
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// selectToolchains puts the bin directories of the tool versions the app asks
+// for in front of its PATH.
+func (e *appEnv) selectToolchains(pathToApp string) error {
+	versions, err := readToolVersions(pathToApp)
+	if err != nil || len(versions) == 0 {
+		return err
+	}
+
+	var dirs, files []string
+	for _, v := range versions {
+		dir, err := v.binDir()
+		if err != nil {
+			return err
+		}
+		if dir == "" {
+			continue
+		}
+		dirs = append(dirs, dir)
+		files = append(files, v.file)
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+	path := strings.Join(dirs, string(os.PathListSeparator))
+	if i, ok := e.index["PATH"]; ok && e.vars[i].Value != "" {
+		path += string(os.PathListSeparator) + e.vars[i].Value
+	}
+	e.set("PATH", path, strings.Join(uniqueStrings(files), ", "))
+	return nil
+}
+
+func uniqueStrings(list []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
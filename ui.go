@@ -1,25 +1,43 @@
 package main
 
 import (
+	"html"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func writeErrorPage(w http.ResponseWriter, err error) {
 	log.Println(err)
+
+	if unavailable, ok := err.(unavailableError); ok {
+		w.Header()["Content-Type"] = []string{"text/plain"}
+		w.Header().Set("Retry-After", strconv.Itoa(int(unavailable.retryAfter/time.Second)))
+		w.WriteHeader(503)
+		w.Write([]byte(unavailable.Error() + ", please try again.\n"))
+		return
+	}
+
 	w.Header()["Content-Type"] = []string{"text/html"}
 	w.WriteHeader(502)
 
 	crash, isCrash := err.(BootCrash)
 	if isCrash {
 		w.Write([]byte("<h1>Your app failed to start :(</h1>"))
+		if crash.Limit != "" {
+			w.Write([]byte("<p>It was killed because it exceeded its <strong>" + crash.Limit + "</strong>.</p>"))
+		}
+		if crash.Procfile != "" {
+			w.Write([]byte("<p>Started from <strong>" + html.EscapeString(crash.Procfile) + "</strong>.</p>"))
+		}
 		w.Write([]byte("<blockquote><pre><span style='opacity:0.5'>" + crash.Path + "$ </span><strong>" + crash.Cmd + "</strong>\n</pre>"))
 
 		w.Write([]byte("<pre id=log>"))
-		crash.Log.WriteTo(w)
+		w.Write(crash.Log)
 		w.Write([]byte("</pre></blockquote>"))
 
-		w.Write([]byte("<h2>Environment</h2><blockquote><pre>"))
+		w.Write([]byte("<h2>Environment</h2><p>Leaving out what the app inherits unchanged from gowd.</p><blockquote><pre>"))
 		for _, e := range crash.Env {
 			w.Write([]byte(e))
 			w.Write([]byte("\n"))
@@ -27,6 +45,23 @@ func writeErrorPage(w http.ResponseWriter, err error) {
 		w.Write([]byte("</pre></blockquote>"))
 
 		w.Write([]byte(terminalFormattingPostamble))
+	} else if configErr, ok := err.(ConfigError); ok {
+		w.Write([]byte("<h1>Your app's configuration is invalid :(</h1>"))
+		w.Write([]byte("<p>Gow can't start it until <strong>" + html.EscapeString(configErr.Path) + "</strong> is fixed:</p>"))
+		w.Write([]byte("<blockquote><pre>" + html.EscapeString(configErr.Error()) + "</pre></blockquote>"))
+		w.Write([]byte("<p>Reload this page once you're done.</p>"))
+	} else if pfErr, ok := err.(ProcfileError); ok {
+		w.Write([]byte("<h1>Your app's Procfile can't be used :(</h1>"))
+		w.Write([]byte("<p>Gow can't start it until these lines of <strong>" + html.EscapeString(pfErr.Path) + "</strong> are fixed:</p>"))
+		for _, p := range pfErr.Problems {
+			w.Write([]byte("<blockquote><pre><span style='opacity:0.5'>" + strconv.Itoa(p.Line) + ": </span>" + html.EscapeString(p.Text) + "\n"))
+			w.Write([]byte("<strong>" + html.EscapeString(p.Message) + "</strong>"))
+			if p.Suggestion != "" {
+				w.Write([]byte(", did you mean:\n<span style='opacity:0.5'>" + strconv.Itoa(p.Line) + ": </span>" + html.EscapeString(p.Suggestion)))
+			}
+			w.Write([]byte("</pre></blockquote>"))
+		}
+		w.Write([]byte("<p>Reload this page once you're done.</p>"))
 	} else {
 		w.WriteHeader(500)
 		w.Write([]byte("An error occured while Gow tried to handle your request: "))
@@ -34,7 +69,16 @@ func writeErrorPage(w http.ResponseWriter, err error) {
 	}
 }
 
-var terminalFormattingPostamble = `<script>
+var terminalFormattingPostamble = ansiFilterScript + `
+
+<script>
+var el = document.getElementById("log")
+el.innerHTML = new Filter().toHtml(log.innerText);
+</script>`
+
+// ansiFilterScript defines Filter, which turns terminal output with ANSI
+// escape codes into HTML.
+var ansiFilterScript = `<script>
 var Filter, STYLES, defaults, entities, extend, toHexString, _i, _results,
     __slice = [].slice;
 
@@ -421,9 +465,4 @@ var Filter, STYLES, defaults, entities, extend, toHexString, _i, _results,
 
   })();
 
-</script>
-
-<script>
-var el = document.getElementById("log")
-el.innerHTML = new Filter().toHtml(log.innerText);
 </script>`
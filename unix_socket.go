@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Backends can listen on a Unix domain socket instead of a TCP port. Their
+// addresses are written as "unix:/path/to.sock" throughout gowd.
+const unixAddressPrefix = "unix:"
+
+func socketDir() string {
+	return os.Getenv("HOME") + "/.pow/.sockets"
+}
+
+// splitAddress returns the network and address to dial for a backend address.
+func splitAddress(address string) (network, addr string) {
+	if strings.HasPrefix(address, unixAddressPrefix) {
+		return "unix", strings.TrimPrefix(address, unixAddressPrefix)
+	}
+	return "tcp", address
+}
+
+func dialBackend(address string, timeout time.Duration) (net.Conn, error) {
+	network, addr := splitAddress(address)
+	return net.DialTimeout(network, addr, timeout)
+}
+
+// unixTransports keeps one http.Transport per socket, so that connections to
+// socket backends are reused just like those to TCP backends.
+var unixTransports = struct {
+	sync.Mutex
+	byPath map[string]*http.Transport
+}{byPath: make(map[string]*http.Transport)}
+
+// transportFor returns the transport to reach the backend at address, and
+// the host to put into request URLs for it.
+func transportFor(address string) (http.RoundTripper, string) {
+	network, path := splitAddress(address)
+	if network != "unix" {
+		return http.DefaultTransport, address
+	}
+
+	unixTransports.Lock()
+	defer unixTransports.Unlock()
+	t := unixTransports.byPath[path]
+	if t == nil {
+		t = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		unixTransports.byPath[path] = t
+	}
+	// the host doesn't matter, the request's Host header is kept anyway
+	return t, "localhost"
+}
+
+// websocketDialerFor is like transportFor, for websocket connections.
+func websocketDialerFor(address string) (*websocket.Dialer, string) {
+	network, path := splitAddress(address)
+	if network != "unix" {
+		return dialer, address
+	}
+	d := *dialer
+	d.NetDial = func(_, _ string) (net.Conn, error) {
+		return net.Dial("unix", path)
+	}
+	return &d, "localhost"
+}
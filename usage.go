@@ -0,0 +1,57 @@
+package main
+
+import "time"
+
+const (
+	usageInterval = 30 * time.Second
+	usageHistory  = 120 // an hour's worth of samples
+)
+
+// resourceUsage is a sample of the resources used by all processes of an app.
+type resourceUsage struct {
+	At         time.Time `json:"at"`
+	Processes  int       `json:"processes"`
+	RSS        int64     `json:"rss_bytes"`
+	CPUSeconds float64   `json:"cpu_seconds"`
+	CPUPercent float64   `json:"cpu_percent"` // since the previous sample
+	Threads    int       `json:"threads"`
+	FDs        int       `json:"fds"`
+}
+
+// watchUsage samples the app's resource usage until it exits.
+func (b *Backend) watchUsage() {
+	for !b.stopped() {
+		usage, ok := processGroupUsage(b.pgid)
+		if !ok {
+			return
+		}
+		b.recordUsage(usage)
+		time.Sleep(usageInterval)
+	}
+}
+
+// recordUsage adds a sample to the history, dropping the oldest ones.
+func (b *Backend) recordUsage(u resourceUsage) {
+	b.usageMtx.Lock()
+	defer b.usageMtx.Unlock()
+
+	if n := len(b.usage); n > 0 {
+		prev := b.usage[n-1]
+		wall := u.At.Sub(prev.At).Seconds()
+		// a process that went away takes its CPU time with it
+		if wall > 0 && u.CPUSeconds > prev.CPUSeconds {
+			u.CPUPercent = (u.CPUSeconds - prev.CPUSeconds) / wall * 100
+		}
+	}
+	b.usage = append(b.usage, u)
+	if len(b.usage) > usageHistory {
+		b.usage = b.usage[len(b.usage)-usageHistory:]
+	}
+}
+
+// Usage returns the recorded samples, oldest first.
+func (b *Backend) Usage() []resourceUsage {
+	b.usageMtx.Lock()
+	defer b.usageMtx.Unlock()
+	return append([]resourceUsage(nil), b.usage...)
+}